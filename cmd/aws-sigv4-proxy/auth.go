@@ -0,0 +1,117 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"aws-sigv4-proxy/config"
+	"aws-sigv4-proxy/handler"
+)
+
+// newAuthenticators builds the authenticators configured on the command line.
+func newAuthenticators() ([]handler.Authenticator, error) {
+	var authenticators []handler.Authenticator
+
+	if *authAPIKeysFile != "" {
+		keys, err := handler.LoadAPIKeys(*authAPIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if *authHtpasswdFile != "" {
+		htpasswd, err := handler.LoadHtpasswd(*authHtpasswdFile, *authRealm)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, htpasswd)
+	}
+
+	if *authJWKSFile != "" || *authJWKSURL != "" {
+		keys := &handler.JWKS{File: *authJWKSFile, URL: *authJWKSURL, RefreshInterval: *authJWKSRefreshInterval}
+		ctx, cancel := context.WithTimeout(context.Background(), handler.DefaultProbeTimeout)
+		defer cancel()
+		if err := keys.Load(ctx); err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, &handler.JWTAuthenticator{
+			Keys:           keys,
+			Issuer:         *authJWTIssuer,
+			Audience:       *authJWTAudience,
+			PrincipalClaim: *authJWTPrincipalClaim,
+			GroupsClaim:    *authJWTGroupsClaim,
+		})
+	}
+
+	return authenticators, nil
+}
+
+// authenticate puts authenticators in front of next. Next is returned as is when there are none, and
+// anyone reaching the proxy gets their requests signed.
+func authenticate(authenticators []handler.Authenticator, next http.Handler) http.Handler {
+	if len(authenticators) == 0 {
+		return next
+	}
+
+	return &handler.Authentication{Authenticators: authenticators, Next: next}
+}
+
+// loadPolicies reads the authorization policy file given on the command line, nil when there is none.
+func loadPolicies() (*config.Policies, error) {
+	if *authPolicyFile == "" {
+		return nil, nil
+	}
+
+	return config.LoadPolicies(*authPolicyFile)
+}
+
+// authorize puts the policies in front of next. Next is returned as is when there are none, and
+// authenticated clients may make any request.
+func authorize(policies *config.Policies, next http.Handler) http.Handler {
+	if policies == nil {
+		return next
+	}
+
+	a := &handler.Authorization{
+		Next:             next,
+		MaxBodySize:      int64(*maxBodySize),
+		MemoryBufferSize: int64(*bodyBufferSize),
+		TempDir:          *bodyTempDir,
+	}
+	for _, policy := range policies.Policies {
+		a.Policies = append(a.Policies, handler.IndexPolicy{
+			Name:       policy.Name,
+			Principals: policy.Principals,
+			Indices:    policy.Indices,
+			Operations: policy.Operations,
+		})
+	}
+
+	return a
+}
+
+// selectRole lets clients select the role requests are signed with through --role-header. Next is
+// returned as is when there is no such header.
+func selectRole(next http.Handler) http.Handler {
+	if *roleHeader == "" {
+		return next
+	}
+
+	return &handler.RoleHeader{Header: *roleHeader, TrustedCallers: *roleTrustedCallers, Next: next}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// ecsDefaultHost is the host of the ECS container credentials endpoint, for relative URIs.
+const ecsDefaultHost = "http://169.254.170.2"
+
+// newCredentials chains the credential providers of --credentials.provider, in order, on top of the
+// credentials of sess. The first provider to retrieve credentials is used until they expire.
+func newCredentials(sess *session.Session) (*credentials.Credentials, error) {
+	var providers []credentials.Provider
+	for _, name := range *credentialsProviders {
+		switch name {
+		case "default":
+			providers = append(providers, &credentialsProvider{creds: sess.Config.Credentials})
+		case "web-identity":
+			if *webIdentityTokenFile == "" || *webIdentityRoleARN == "" {
+				return nil, fmt.Errorf("the web-identity credentials provider requires --web-identity.token-file and --web-identity.role-arn")
+			}
+			sessionName := *webIdentitySessionName
+			if sessionName == "" {
+				sessionName = roleSessionName()
+			}
+			providers = append(providers, &namedProvider{
+				Provider: stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), *webIdentityRoleARN, sessionName, stscreds.FetchTokenPath(*webIdentityTokenFile)),
+				name:     name,
+			})
+		case "pod-identity":
+			providers = append(providers, newEndpointProvider(sess, name, *podIdentityEndpoint, *podIdentityTokenFile, ""))
+		case "ecs":
+			endpoint := *ecsEndpoint
+			if endpoint == "" {
+				endpoint = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+			}
+			if endpoint == "" {
+				if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+					endpoint = ecsDefaultHost + uri
+				}
+			}
+			if endpoint == "" {
+				return nil, fmt.Errorf("the ecs credentials provider requires --ecs.endpoint or an AWS_CONTAINER_CREDENTIALS_*_URI environment variable")
+			}
+			providers = append(providers, newEndpointProvider(sess, name, endpoint, *ecsTokenFile, os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")))
+		}
+	}
+
+	// Report why every provider failed, rather than that none succeeded
+	return credentials.NewCredentials(&credentials.ChainProvider{
+		Providers:     providers,
+		VerboseErrors: true,
+	}), nil
+}
+
+// logCredentialsProvider retrieves the credentials and logs which provider they came from.
+func logCredentialsProvider(ctx context.Context, creds *credentials.Credentials) {
+	v, err := creds.GetWithContext(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to retrieve AWS credentials")
+		return
+	}
+
+	log.WithField("provider", v.ProviderName).Infof("Using AWS credentials from %s", v.ProviderName)
+}
+
+// credentialsProvider turns credentials, such as the default ones of a session, into a provider.
+type credentialsProvider struct {
+	creds *credentials.Credentials
+}
+
+func (p *credentialsProvider) Retrieve() (credentials.Value, error) {
+	return p.creds.Get()
+}
+
+func (p *credentialsProvider) IsExpired() bool {
+	return p.creds.IsExpired()
+}
+
+// namedProvider reports the credentials of a provider under name.
+type namedProvider struct {
+	credentials.Provider
+	name string
+}
+
+func (p *namedProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.Provider.Retrieve()
+	v.ProviderName = p.name
+	return v, err
+}
+
+// endpointProvider retrieves credentials from a container credentials endpoint, such as the ones of
+// EKS Pod Identity and ECS. The authorization token is read from tokenFile on every retrieval, as it
+// is rotated, or is the static token when there is no file.
+type endpointProvider struct {
+	endpoint  *endpointcreds.Provider
+	name      string
+	tokenFile string
+}
+
+func newEndpointProvider(sess *session.Session, name, endpoint, tokenFile, token string) *endpointProvider {
+	cfg := sess.Config.Copy(&aws.Config{Credentials: credentials.AnonymousCredentials})
+	return &endpointProvider{
+		endpoint: endpointcreds.NewProviderClient(*cfg, sess.Handlers, endpoint, func(p *endpointcreds.Provider) {
+			p.ExpiryWindow = 5 * time.Minute
+			p.AuthorizationToken = token
+		}).(*endpointcreds.Provider),
+		name:      name,
+		tokenFile: tokenFile,
+	}
+}
+
+func (p *endpointProvider) Retrieve() (credentials.Value, error) {
+	if p.tokenFile != "" {
+		token, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return credentials.Value{ProviderName: p.name}, err
+		}
+		p.endpoint.AuthorizationToken = strings.TrimSpace(string(token))
+	}
+
+	v, err := p.endpoint.Retrieve()
+	v.ProviderName = p.name
+	return v, err
+}
+
+func (p *endpointProvider) IsExpired() bool {
+	return p.endpoint.IsExpired()
+}
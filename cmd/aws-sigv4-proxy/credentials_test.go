@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCredentialsEndpoint answers like the EKS Pod Identity and ECS credentials endpoints to requests
+// with the expected authorization token, and with a 500 when failing.
+type fakeCredentialsEndpoint struct {
+	accessKeyID string
+	token       string
+	failing     bool
+	tokens      []string
+}
+
+func (f *fakeCredentialsEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	if f.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"code": "InternalError", "message": "failing"})
+		return
+	}
+	if r.Header.Get("Authorization") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"code": "AccessDenied", "message": "wrong token"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"AccessKeyId":     f.accessKeyID,
+		"SecretAccessKey": "secret",
+		"Token":           "token",
+		"AccountId":       "123456789012",
+		"Expiration":      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+}
+
+func TestNewCredentials(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("eyJ.token"), 0600))
+
+	sts := &fakeSTS{}
+	sess := newFakeSTSSession(t, sts)
+
+	podIdentity := &fakeCredentialsEndpoint{accessKeyID: "AKIDPOD", token: "eyJ.token"}
+	podIdentityServer := httptest.NewServer(podIdentity)
+	defer podIdentityServer.Close()
+	ecs := &fakeCredentialsEndpoint{accessKeyID: "AKIDECS", token: "static"}
+	ecsServer := httptest.NewServer(ecs)
+	defer ecsServer.Close()
+
+	*webIdentityTokenFile = tokenFile
+	*webIdentityRoleARN = "arn:aws:iam::123456789012:role/irsa"
+	*webIdentitySessionName = "pod"
+	*podIdentityEndpoint = podIdentityServer.URL + "/v1/credentials"
+	*podIdentityTokenFile = tokenFile
+	*ecsEndpoint = ecsServer.URL
+	*ecsTokenFile = ""
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "static")
+
+	tests := []struct {
+		name         string
+		providers    []string
+		failing      bool
+		wantProvider string
+		wantKey      string
+	}{
+		{name: "should use the default credentials", providers: []string{"default"}, wantProvider: "StaticProvider", wantKey: "base"},
+		{name: "should assume roles with web identity tokens", providers: []string{"web-identity", "default"}, wantProvider: "web-identity", wantKey: "irsa"},
+		{name: "should retrieve EKS Pod Identity credentials", providers: []string{"pod-identity"}, wantProvider: "pod-identity", wantKey: "AKIDPOD"},
+		{name: "should retrieve ECS credentials", providers: []string{"ecs", "default"}, wantProvider: "ecs", wantKey: "AKIDECS"},
+		{name: "should fall back to the next provider", providers: []string{"pod-identity", "ecs"}, failing: true, wantProvider: "ecs", wantKey: "AKIDECS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*credentialsProviders = tt.providers
+			podIdentity.failing = tt.failing
+
+			creds, err := newCredentials(sess)
+			assert.NoError(t, err)
+			v, err := creds.Get()
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantProvider, v.ProviderName)
+			assert.Equal(t, tt.wantKey, v.AccessKeyID)
+		})
+	}
+
+	if assert.Len(t, sts.calls, 1) {
+		assert.Equal(t, "AssumeRoleWithWebIdentity", sts.calls[0].Get("Action"))
+		assert.Equal(t, "eyJ.token", sts.calls[0].Get("WebIdentityToken"))
+		assert.Equal(t, "pod", sts.calls[0].Get("RoleSessionName"))
+	}
+	for _, token := range podIdentity.tokens {
+		assert.Equal(t, "eyJ.token", token)
+	}
+}
+
+func TestNewCredentialsRequiresWebIdentityRole(t *testing.T) {
+	*credentialsProviders = []string{"web-identity"}
+	*webIdentityTokenFile = ""
+
+	_, err := newCredentials(newFakeSTSSession(t, &fakeSTS{}))
+
+	assert.EqualError(t, err, "the web-identity credentials provider requires --web-identity.token-file and --web-identity.role-arn")
+}
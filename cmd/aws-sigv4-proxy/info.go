@@ -0,0 +1,74 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"regexp"
+
+	"aws-sigv4-proxy/config"
+	"aws-sigv4-proxy/handler"
+)
+
+// newInfoHandler answers GET / with the identity and profiles of the configuration file, on top
+// of the default one, or of an Elasticsearch 7 one for Elasticsearch clients.
+func newInfoHandler(info *config.Info, elasticsearchCompat bool) *handler.InfoHandler {
+	h := &handler.InfoHandler{Info: handler.DefaultInfo()}
+	if elasticsearchCompat {
+		h.Info = handler.ElasticsearchInfo()
+	}
+	if info == nil {
+		return h
+	}
+
+	h.Info = withIdentity(h.Info, info.Identity)
+	for _, profile := range info.Profiles {
+		h.Profiles = append(h.Profiles, handler.InfoProfile{
+			Name: profile.Name,
+			// Validated when the configuration was loaded
+			UserAgent: regexp.MustCompile(profile.UserAgent),
+			Info:      withIdentity(h.Info, profile.Identity),
+		})
+	}
+
+	return h
+}
+
+// withIdentity returns info with the fields set in id replaced.
+func withIdentity(info handler.Info, id config.Identity) handler.Info {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+
+	set(&info.Name, id.NodeName)
+	set(&info.ClusterName, id.ClusterName)
+	set(&info.ClusterUuid, id.ClusterUUID)
+	set(&info.TagLine, id.TagLine)
+	if id.Version.Distribution != nil {
+		info.Version.Distribution = *id.Version.Distribution
+	}
+	set(&info.Version.Number, id.Version.Number)
+	set(&info.Version.BuildFlavor, id.Version.BuildFlavor)
+	set(&info.Version.BuildType, id.Version.BuildType)
+	set(&info.Version.BuildHash, id.Version.BuildHash)
+	set(&info.Version.BuildDate, id.Version.BuildDate)
+	set(&info.Version.LuceneVersion, id.Version.LuceneVersion)
+	set(&info.Version.MinimumWireCompatibilityVersion, id.Version.MinimumWireCompatibilityVersion)
+	set(&info.Version.MinimumIndexCompatibilityVersion, id.Version.MinimumIndexCompatibilityVersion)
+
+	return info
+}
@@ -16,38 +16,110 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"aws-sigv4-proxy/config"
 	"aws-sigv4-proxy/handler"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
-	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
-
-	"github.com/gorilla/mux"
 )
 
 var (
-	debug                  = kingpin.Flag("verbose", "Enable additional logging, implies all the log-* options").Short('v').Envar("DEBUG").Bool()
-	logFailedResponse      = kingpin.Flag("log-failed-requests", "Log 4xx and 5xx response body").Envar("LOG_FAILED_RESPONSE").Bool()
-	logSinging             = kingpin.Flag("log-signing-process", "Log sigv4 signing process").Envar("LOG_SIGNING").Bool()
-	port                   = kingpin.Flag("port", "Port to serve http on").Default(":8080").Envar("PORT").String()
-	strip                  = kingpin.Flag("strip", "Headers to strip from incoming request").Short('s').Envar("STRIP").Strings()
-	roleArn                = kingpin.Flag("role-arn", "Amazon Resource Name (ARN) of the role to assume").Envar("ROLE_ARN").String()
-	signingNameOverride    = kingpin.Flag("name", "AWS Service to sign for").Envar("NAME").String()
-	hostOverride           = kingpin.Flag("host", "Host to proxy to").Envar("HOST").String()
-	regionOverride         = kingpin.Flag("region", "AWS region to sign for").Envar("REGION").String()
-	disableSSLVerification = kingpin.Flag("no-verify-ssl", "Disable peer SSL certificate validation").Envar("NO_VERIFY_SSL").Bool()
-	idleConnTimeout        = kingpin.Flag("transport.idle-conn-timeout", "Idle timeout to the upstream service").Envar("TRANSPORT_IDLE_CONN_TIMEOUT").Default("40s").Duration()
+	debug                   = kingpin.Flag("verbose", "Enable additional logging, implies all the log-* options").Short('v').Envar("DEBUG").Bool()
+	logFailedResponse       = kingpin.Flag("log-failed-requests", "Log 4xx and 5xx response body").Envar("LOG_FAILED_RESPONSE").Bool()
+	logSinging              = kingpin.Flag("log-signing-process", "Log sigv4 signing process").Envar("LOG_SIGNING").Bool()
+	port                    = kingpin.Flag("port", "Port to serve http on").Default(":8080").Envar("PORT").String()
+	adminPort               = kingpin.Flag("admin-port", "Port to serve /metrics on, empty to disable").Default(":8081").Envar("ADMIN_PORT").String()
+	otlpEndpoint            = kingpin.Flag("otlp-endpoint", "OTLP/HTTP host:port to export traces to, empty to disable tracing").Envar("OTLP_ENDPOINT").String()
+	otlpInsecure            = kingpin.Flag("otlp-insecure", "Export traces over plain HTTP").Envar("OTLP_INSECURE").Bool()
+	traceSampleRatio        = kingpin.Flag("trace-sample-ratio", "Ratio of traces sampled when the incoming request is not traced").Envar("TRACE_SAMPLE_RATIO").Default("1").Float64()
+	configFile              = kingpin.Flag("config", "YAML or JSON file declaring upstream routes, replaces the per-route flags").Envar("CONFIG").String()
+	configReloadInterval    = kingpin.Flag("config-reload-interval", "Interval to check the configuration file for changes, 0 reloads on SIGHUP only").Envar("CONFIG_RELOAD_INTERVAL").Default("10s").Duration()
+	strip                   = kingpin.Flag("strip", "Headers to strip from incoming request").Short('s').Envar("STRIP").Strings()
+	roleArn                 = kingpin.Flag("role-arn", "Amazon Resource Name (ARN) of the role to assume").Envar("ROLE_ARN").String()
+	credentialsProviders    = kingpin.Flag("credentials.provider", "Credential provider to try, in order, default, web-identity, pod-identity or ecs").Envar("CREDENTIALS_PROVIDER").Default("default").Enums("default", "web-identity", "pod-identity", "ecs")
+	webIdentityTokenFile    = kingpin.Flag("web-identity.token-file", "File of the web identity token to assume --web-identity.role-arn with").Envar("WEB_IDENTITY_TOKEN_FILE").String()
+	webIdentityRoleARN      = kingpin.Flag("web-identity.role-arn", "ARN of the role to assume with the web identity token").Envar("WEB_IDENTITY_ROLE_ARN").String()
+	webIdentitySessionName  = kingpin.Flag("web-identity.session-name", "Session name of the web identity role, derived from the hostname when empty").Envar("WEB_IDENTITY_SESSION_NAME").String()
+	podIdentityEndpoint     = kingpin.Flag("pod-identity.endpoint", "EKS Pod Identity credentials endpoint").Envar("POD_IDENTITY_ENDPOINT").Default("http://169.254.170.23/v1/credentials").String()
+	podIdentityTokenFile    = kingpin.Flag("pod-identity.token-file", "File of the EKS Pod Identity authorization token").Envar("POD_IDENTITY_TOKEN_FILE").Default("/var/run/secrets/pods.eks.amazonaws.com/serviceaccount/eks-pod-identity-token").String()
+	ecsEndpoint             = kingpin.Flag("ecs.endpoint", "ECS container credentials endpoint, from AWS_CONTAINER_CREDENTIALS_*_URI when empty").Envar("ECS_ENDPOINT").String()
+	ecsTokenFile            = kingpin.Flag("ecs.token-file", "File of the ECS credentials endpoint authorization token").Envar("ECS_TOKEN_FILE").String()
+	roleExternalID          = kingpin.Flag("role-external-id", "External ID to assume the first role with").Envar("ROLE_EXTERNAL_ID").String()
+	roleDuration            = kingpin.Flag("role-duration", "Duration of the first role credentials, 0 for the STS default").Envar("ROLE_DURATION").Default("0").Duration()
+	rolePolicy              = kingpin.Flag("role-policy", "Inline session policy, a JSON document, to assume the first role with").Envar("ROLE_POLICY").String()
+	rolePolicyARNs          = kingpin.Flag("role-policy-arn", "ARN of a managed session policy to assume the first role with").Envar("ROLE_POLICY_ARN").Strings()
+	roleTags                = kingpin.Flag("role-tag", "Session tag to assume the first role with, as <key>=<value>").Envar("ROLE_TAG").StringMap()
+	roleTransitiveTagKeys   = kingpin.Flag("role-transitive-tag-key", "Key of a session tag passed on to chained roles").Envar("ROLE_TRANSITIVE_TAG_KEY").Strings()
+	roleSourceIdentity      = kingpin.Flag("role-source-identity", "Source identity to assume the first role with").Envar("ROLE_SOURCE_IDENTITY").String()
+	roleChain               = kingpin.Flag("role-chain", "ARN of a role assumed before --role-arn, in order").Envar("ROLE_CHAIN").Strings()
+	roleMappings            = kingpin.Flag("role-mapping", "Role to assume for the requests of a client, as <principal>=<role ARN>").Envar("ROLE_MAPPING").StringMap()
+	roleHeader              = kingpin.Flag("role-header", "Header selecting a role mapping by name, such as X-Proxy-Role").Envar("ROLE_HEADER").String()
+	roleTrustedCallers      = kingpin.Flag("role-header-trusted-caller", "Principal, or group:<name>, that may select any role mapping with --role-header").Envar("ROLE_HEADER_TRUSTED_CALLER").Strings()
+	signingNameOverride     = kingpin.Flag("name", "AWS Service to sign for").Envar("NAME").String()
+	hostOverride            = kingpin.Flag("host", "Host to proxy to").Envar("HOST").String()
+	regionOverride          = kingpin.Flag("region", "AWS region to sign for").Envar("REGION").String()
+	disableSSLVerification  = kingpin.Flag("no-verify-ssl", "Disable peer SSL certificate validation").Envar("NO_VERIFY_SSL").Bool()
+	readinessTimeout        = kingpin.Flag("readiness.timeout", "Time given to the readiness checks").Envar("READINESS_TIMEOUT").Default("5s").Duration()
+	readinessCheckUpstream  = kingpin.Flag("readiness.check-upstream", "Make a signed request to every upstream on readiness checks").Envar("READINESS_CHECK_UPSTREAM").Bool()
+	readinessUpstreamPath   = kingpin.Flag("readiness.upstream-path", "Path requested from upstreams on readiness and cluster health checks").Envar("READINESS_UPSTREAM_PATH").Default("/").String()
+	elasticsearchCompat     = kingpin.Flag("elasticsearch-compat", "Make the proxy look like Elasticsearch 7 to Elasticsearch clients").Envar("ELASTICSEARCH_COMPAT").Bool()
+	clusterHealthMode       = kingpin.Flag("cluster-health.mode", "Answer _cluster/health with a static green (static) or from the collection status (collection)").Envar("CLUSTER_HEALTH_MODE").Default("static").Enum("static", "collection")
+	clusterHealthProbe      = kingpin.Flag("cluster-health.probe", "Count a signed request to upstream towards the collection health").Envar("CLUSTER_HEALTH_PROBE").Default("true").Bool()
+	clusterHealthTTL        = kingpin.Flag("cluster-health.ttl", "Time to cache the collection health for").Envar("CLUSTER_HEALTH_TTL").Default("10s").Duration()
+	clusterHealthEndpoint   = kingpin.Flag("cluster-health.endpoint", "OpenSearch Serverless control plane endpoint, the regional one when empty").Envar("CLUSTER_HEALTH_ENDPOINT").String()
+	statsTTL                = kingpin.Flag("stats.ttl", "Time to cache the document counts reported by _stats for").Envar("STATS_TTL").Default("5s").Duration()
+	refreshPolicy           = kingpin.Flag("refresh.policy", "Answer _refresh with a fake success (fake), an error (error) or once the document count is stable (emulate)").Envar("REFRESH_POLICY").Default("fake").Enum("fake", "error", "emulate")
+	refreshInterval         = kingpin.Flag("refresh.interval", "Time between checks when emulating _refresh or the refresh parameter of writes").Envar("REFRESH_INTERVAL").Default("1s").Duration()
+	refreshTimeout          = kingpin.Flag("refresh.timeout", "Maximum time to wait when emulating _refresh or the refresh parameter of writes").Envar("REFRESH_TIMEOUT").Default("10s").Duration()
+	forceMergePolicy        = kingpin.Flag("forcemerge.policy", "Answer _forcemerge with a fake success (fake or emulate) or an error (error)").Envar("FORCEMERGE_POLICY").Default("fake").Enum("fake", "error", "emulate")
+	queryProfile            = kingpin.Flag("query-rules.profile", "Built-in query parameter rules, aoss for AOSS upstreams when auto").Envar("QUERY_RULES_PROFILE").Default("auto").Enum("auto", "aoss", "none")
+	authAPIKeysFile         = kingpin.Flag("auth.api-keys-file", "File of name:key lines, clients send Authorization: ApiKey").Envar("AUTH_API_KEYS_FILE").String()
+	authHtpasswdFile        = kingpin.Flag("auth.htpasswd-file", "htpasswd file of bcrypt hashes, clients send HTTP Basic credentials").Envar("AUTH_HTPASSWD_FILE").String()
+	authRealm               = kingpin.Flag("auth.realm", "Realm of the HTTP Basic challenge").Envar("AUTH_REALM").Default("aws-sigv4-proxy").String()
+	authJWKSFile            = kingpin.Flag("auth.jwks-file", "JSON Web Key Set file of the keys signing client JWTs").Envar("AUTH_JWKS_FILE").String()
+	authJWKSURL             = kingpin.Flag("auth.jwks-url", "JSON Web Key Set URL of the keys signing client JWTs").Envar("AUTH_JWKS_URL").String()
+	authJWKSRefreshInterval = kingpin.Flag("auth.jwks-refresh-interval", "Interval to fetch the JSON Web Key Set URL again").Envar("AUTH_JWKS_REFRESH_INTERVAL").Default("1h").Duration()
+	authJWTIssuer           = kingpin.Flag("auth.jwt-issuer", "Issuer client JWTs must have, any when empty").Envar("AUTH_JWT_ISSUER").String()
+	authJWTAudience         = kingpin.Flag("auth.jwt-audience", "Audience client JWTs must have, any when empty").Envar("AUTH_JWT_AUDIENCE").String()
+	authJWTPrincipalClaim   = kingpin.Flag("auth.jwt-principal-claim", "JWT claim naming the client").Envar("AUTH_JWT_PRINCIPAL_CLAIM").Default("sub").String()
+	authJWTGroupsClaim      = kingpin.Flag("auth.jwt-groups-claim", "JWT claim listing the groups of the client").Envar("AUTH_JWT_GROUPS_CLAIM").String()
+	authPolicyFile          = kingpin.Flag("auth.policy-file", "File of the index policies authorizing authenticated clients").Envar("AUTH_POLICY_FILE").String()
+	readTimeout             = kingpin.Flag("server.read-timeout", "Maximum duration for reading an entire request, 0 for no limit").Envar("SERVER_READ_TIMEOUT").Default("0").Duration()
+	writeTimeout            = kingpin.Flag("server.write-timeout", "Maximum duration for writing a response, 0 for no limit").Envar("SERVER_WRITE_TIMEOUT").Default("0").Duration()
+	idleTimeout             = kingpin.Flag("server.idle-timeout", "Time to keep idle client connections open").Envar("SERVER_IDLE_TIMEOUT").Default("120s").Duration()
+	shutdownDelay           = kingpin.Flag("shutdown.delay", "Time to keep serving with readiness failing before draining").Envar("SHUTDOWN_DELAY").Default("0").Duration()
+	drainTimeout            = kingpin.Flag("shutdown.drain-timeout", "Time to wait for in-flight requests when shutting down").Envar("SHUTDOWN_DRAIN_TIMEOUT").Default("30s").Duration()
+	idleConnTimeout         = kingpin.Flag("transport.idle-conn-timeout", "Idle timeout to the upstream service").Envar("TRANSPORT_IDLE_CONN_TIMEOUT").Default("40s").Duration()
+	retryMaxAttempts        = kingpin.Flag("retry.max-attempts", "Attempts made at an upstream request, including the first one").Envar("RETRY_MAX_ATTEMPTS").Default("1").Int()
+	retryBaseBackoff        = kingpin.Flag("retry.base-backoff", "Wait before the first retry, doubled on every following one").Envar("RETRY_BASE_BACKOFF").Default("100ms").Duration()
+	retryMaxBackoff         = kingpin.Flag("retry.max-backoff", "Maximum wait between attempts").Envar("RETRY_MAX_BACKOFF").Default("5s").Duration()
+	retryJitter             = kingpin.Flag("retry.jitter", "Fraction of the backoff that is randomised").Envar("RETRY_JITTER").Default("0.2").Float64()
+	retryStatusCodes        = kingpin.Flag("retry.status-codes", "Upstream status codes to retry").Envar("RETRY_STATUS_CODES").Default("429", "502", "503", "504").Ints()
+	retryMethods            = kingpin.Flag("retry.methods", "HTTP methods safe to retry").Envar("RETRY_METHODS").Default("GET", "HEAD", "OPTIONS", "PUT", "DELETE").Strings()
+	retryAPIs               = kingpin.Flag("retry.apis", "OpenSearch APIs safe to retry whatever their method").Envar("RETRY_APIS").Default("_bulk", "_search", "_msearch", "_mget", "_count").Strings()
+	bulkRetryMaxAttempts    = kingpin.Flag("bulk-retry.max-attempts", "Attempts made at the items of a _bulk request, 1 disables resubmitting failed items").Envar("BULK_RETRY_MAX_ATTEMPTS").Default("1").Int()
+	bulkRetryStatusCodes    = kingpin.Flag("bulk-retry.status-codes", "_bulk item statuses to resubmit").Envar("BULK_RETRY_STATUS_CODES").Default("429").Ints()
+	bulkSplitMaxSize        = kingpin.Flag("bulk-split.max-size", "Largest _bulk request sent upstream, larger ones are split, 0 for no limit").Envar("BULK_SPLIT_MAX_SIZE").Default("0").Bytes()
+	bulkSplitMaxItems       = kingpin.Flag("bulk-split.max-items", "Most items in a _bulk request sent upstream, larger ones are split, 0 for no limit").Envar("BULK_SPLIT_MAX_ITEMS").Default("0").Int()
+	bulkSplitConcurrency    = kingpin.Flag("bulk-split.concurrency", "Parts of a split _bulk request sent at once").Envar("BULK_SPLIT_CONCURRENCY").Default("1").Int()
+	maxBodySize             = kingpin.Flag("max-body-size", "Maximum request body size, 0 for no limit").Envar("MAX_BODY_SIZE").Default("0").Bytes()
+	bodyBufferSize          = kingpin.Flag("body-buffer-size", "Request body size kept in memory before spooling to disk").Envar("BODY_BUFFER_SIZE").Default("8MiB").Bytes()
+	bodyTempDir             = kingpin.Flag("body-temp-dir", "Directory to spool large request bodies to").Envar("BODY_TEMP_DIR").String()
+	flushInterval           = kingpin.Flag("flush-interval", "Flush interval for streamed responses, negative flushes every write").Envar("FLUSH_INTERVAL").Default("100ms").Duration()
 )
 
 type awsLoggerAdapter struct {
@@ -88,6 +160,12 @@ func main() {
 		sess.Config.Region = &defaultRegion
 	}
 
+	creds, err := newCredentials(sess)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sess.Config.Credentials = creds
+
 	if *disableSSLVerification {
 		log.Warn("Peer SSL Certificate validation is DISABLED")
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
@@ -95,58 +173,109 @@ func main() {
 
 	http.DefaultTransport.(*http.Transport).IdleConnTimeout = *idleConnTimeout
 
-	var creds *credentials.Credentials
-	if *roleArn != "" {
-		creds = stscreds.NewCredentials(sess, *roleArn, func(p *stscreds.AssumeRoleProvider) {
-			p.RoleSessionName = roleSessionName()
-		})
-	} else {
-		creds = sess.Config.Credentials
+	credsCtx, cancel := context.WithTimeout(context.Background(), *readinessTimeout)
+	logCredentialsProvider(credsCtx, creds)
+	cancel()
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if *otlpEndpoint != "" {
+		shutdownTracing, err = setupTracing(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{"endpoint": *otlpEndpoint}).Infof("Exporting traces to %s", *otlpEndpoint)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authenticators, err := newAuthenticators()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(authenticators) > 0 {
+		log.WithField("authenticators", len(authenticators)).Info("Authenticating clients")
+	}
+	if len(*roleMappings) > 0 && len(authenticators) == 0 {
+		log.Fatal("--role-mapping requires clients to be authenticated")
 	}
 
-	signer := v4.NewSigner(creds, func(s *v4.Signer) {
-		if shouldLogSigning() {
-			s.Logger = awsLoggerAdapter{}
-			s.Debug = aws.LogDebugWithSigning
+	policies, err := loadPolicies()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if policies != nil {
+		if len(authenticators) == 0 {
+			log.Fatal("--auth.policy-file requires clients to be authenticated")
 		}
-	})
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	log.WithFields(log.Fields{"StripHeaders": *strip}).Infof("Stripping headers %s", *strip)
-	log.WithFields(log.Fields{"port": *port}).Infof("Listening on %s", *port)
-
-	router := mux.NewRouter()
-	router.HandleFunc("/", handler.GetInfo).Methods("GET")
-	router.HandleFunc("/_stats/{metrics}", handler.GetNodesInfo).Methods("GET")
-	router.HandleFunc("/_nodes/stats", handler.GetNodesInfo).Methods("GET")
-	router.HandleFunc("/_nodes/stats/{metrics}", handler.GetNodesInfo).Methods("GET")
-	router.HandleFunc("/_all/_stats/_all", handler.GetIndexStats).Methods("GET") // not sure why this is not handled by the parameterized one.
-	router.HandleFunc("/{index}/_stats/{metrics}", handler.GetIndexStats).Methods("GET")
-	router.HandleFunc("/_nodes/{node_id}", handler.GetNodesInfo).Methods("GET")
-	router.HandleFunc("/_cluster/health", handler.GetHealthInfo).Methods("GET")
-	router.HandleFunc("/_cluster/health/{index}", handler.GetHealthInfo).Methods("GET")
-	router.HandleFunc("/{index}/_refresh", handler.RefreshAll).Methods("POST")
-	router.HandleFunc("/{index}/_forcemerge", handler.ForceMerge).Methods("POST")
-
-	router.NotFoundHandler = &handler.Handler{
-		ProxyClient: &handler.ProxyClient{
-			Signer:              signer,
-			Client:              client,
-			StripRequestHeaders: *strip,
-			SigningNameOverride: *signingNameOverride,
-			HostOverride:        *hostOverride,
-			RegionOverride:      *regionOverride,
-			LogFailedRequest:    *logFailedResponse,
-		},
-	}
-
-	log.Fatal(
-		http.ListenAndServe(*port, router),
-	)
+		log.WithField("policies", len(policies.Policies)).Info("Authorizing clients")
+	}
+
+	probes := &handler.Probes{Timeout: *readinessTimeout}
+	routes, checks := buildRoutes(sess, cfg, policies)
+	probes.SetChecks(checks)
+
+	routers := map[string]*handler.Router{}
+	for listen, routes := range routes {
+		routers[listen] = handler.NewRouter(routes)
+	}
+
+	if *configFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+
+		go config.Watch(context.Background(), *configFile, *configReloadInterval, reload, func(cfg *config.Config) {
+			reloadRoutes(sess, cfg, policies, routers, probes)
+		})
+	}
+
+	var servers []*server
+	errs := make(chan error, len(routers)+1)
+	if *adminPort != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", promhttp.Handler())
+
+		log.WithFields(log.Fields{"port": *adminPort}).Infof("Serving metrics on %s", *adminPort)
+		s := newServer(*adminPort, admin)
+		servers = append(servers, s)
+		go s.serve(errs)
+	}
+
+	for listen, router := range routers {
+		log.WithFields(log.Fields{"port": listen}).Infof("Listening on %s", listen)
+		s := newServer(listen, probes.Handler(authenticate(authenticators, selectRole(router))))
+		servers = append(servers, s)
+		go s.serve(errs)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err = <-errs:
+		log.WithError(err).Error("Server failed, shutting down")
+	case sig := <-stop:
+		log.WithField("signal", sig).Infof("Received %s, shutting down", sig)
+	}
+
+	probes.ShutDown()
+	if *shutdownDelay > 0 && err == nil {
+		time.Sleep(*shutdownDelay)
+	}
+	drain(servers, *drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if tErr := shutdownTracing(ctx); tErr != nil {
+		log.WithError(tErr).Warn("Unable to flush traces")
+	}
+
+	if err != nil {
+		log.Exit(1)
+	}
+	log.Info("Shut down")
 }
 
 func shouldLogSigning() bool {
@@ -154,6 +283,10 @@ func shouldLogSigning() bool {
 }
 
 func roleSessionName() string {
+	return "aws-aoss-proxy-" + sessionSuffix()
+}
+
+func sessionSuffix() string {
 	suffix, err := os.Hostname()
 
 	if err != nil {
@@ -161,5 +294,21 @@ func roleSessionName() string {
 		suffix = strconv.FormatInt(now, 10)
 	}
 
-	return "aws-aoss-proxy-" + suffix
+	return suffix
+}
+
+// clientSessionName is the session name of the role of a client, which must be 64 characters at most
+// of the set [\w+=,.@-].
+func clientSessionName(client string) string {
+	name := []byte("aws-aoss-proxy-" + client + "-" + sessionSuffix())
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_+=,.@-", c) >= 0) {
+			name[i] = '-'
+		}
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return string(name)
 }
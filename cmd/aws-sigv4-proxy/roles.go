@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"aws-sigv4-proxy/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// flagAssumeRole returns the AssumeRole options given on the command line, nil when there are none.
+func flagAssumeRole() *config.AssumeRole {
+	opts := &config.AssumeRole{
+		ExternalID:        *roleExternalID,
+		Duration:          config.Duration(*roleDuration),
+		Policy:            *rolePolicy,
+		PolicyARNs:        *rolePolicyARNs,
+		Tags:              *roleTags,
+		TransitiveTagKeys: *roleTransitiveTagKeys,
+		SourceIdentity:    *roleSourceIdentity,
+	}
+	if opts.ExternalID == "" && opts.Duration == 0 && opts.Policy == "" && len(opts.PolicyARNs) == 0 &&
+		len(opts.Tags) == 0 && len(opts.TransitiveTagKeys) == 0 && opts.SourceIdentity == "" {
+		return nil
+	}
+
+	return opts
+}
+
+// flagRoleChain returns the roles to chain through given on the command line. The first one is assumed
+// with opts, which then do not apply to --role-arn: STS refuses chained calls asking for more than an
+// hour or setting transitive tags again, and external IDs are meant for the role entering the account.
+func flagRoleChain(opts *config.AssumeRole) []config.ChainedRole {
+	var chain []config.ChainedRole
+	for _, roleARN := range *roleChain {
+		chain = append(chain, config.ChainedRole{RoleARN: roleARN})
+	}
+	if len(chain) > 0 && opts != nil {
+		chain[0].AssumeRole = *opts
+	}
+
+	return chain
+}
+
+// chainRoles returns a copy of sess whose credentials are those of the last role of chain, each role
+// being assumed with the credentials of the previous one.
+func chainRoles(sess *session.Session, chain []config.ChainedRole) *session.Session {
+	for i := range chain {
+		creds := assumeRole(sess, chain[i].RoleARN, roleSessionName(), &chain[i].AssumeRole)
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+
+	return sess
+}
+
+// assumeRole returns the credentials of roleARN, assumed with the credentials of sess and opts, which
+// may be nil. They are cached until they are about to expire.
+func assumeRole(sess *session.Session, roleARN, sessionName string, opts *config.AssumeRole) *credentials.Credentials {
+	return stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		if opts == nil {
+			return
+		}
+
+		if opts.ExternalID != "" {
+			p.ExternalID = aws.String(opts.ExternalID)
+		}
+		if opts.Duration != 0 {
+			p.Duration = time.Duration(opts.Duration)
+		}
+		if opts.Policy != "" {
+			p.Policy = aws.String(opts.Policy)
+		}
+		for _, arn := range opts.PolicyARNs {
+			p.PolicyArns = append(p.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(arn)})
+		}
+
+		// Sort the tags for the calls to be the same from one refresh to the next
+		keys := make([]string, 0, len(opts.Tags))
+		for key := range opts.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p.Tags = append(p.Tags, &sts.Tag{Key: aws.String(key), Value: aws.String(opts.Tags[key])})
+		}
+		p.TransitiveTagKeys = aws.StringSlice(opts.TransitiveTagKeys)
+
+		// The provider has no source identity option, the STS client sets it on every call
+		if opts.SourceIdentity != "" {
+			p.Client = &sourceIdentityClient{STS: sts.New(sess), sourceIdentity: opts.SourceIdentity}
+		}
+	})
+}
+
+// sourceIdentityClient sets the source identity of the AssumeRole calls it makes.
+type sourceIdentityClient struct {
+	*sts.STS
+	sourceIdentity string
+}
+
+func (c *sourceIdentityClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	return c.AssumeRoleWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *sourceIdentityClient) AssumeRoleWithContext(ctx aws.Context, input *sts.AssumeRoleInput, opts ...request.Option) (*sts.AssumeRoleOutput, error) {
+	input.SourceIdentity = aws.String(c.sourceIdentity)
+	return c.STS.AssumeRoleWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aws-sigv4-proxy/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSTS answers AssumeRole and AssumeRoleWithWebIdentity calls with credentials whose access key is
+// the role name, and records the calls along with the access key they were signed with, if any. Like
+// STS, it refuses chained calls asking for more than an hour or setting transitive tags again.
+type fakeSTS struct {
+	mu         sync.Mutex
+	calls      []url.Values
+	keys       []string
+	transitive map[string][]string
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.PostForm)
+	key := ""
+	if fields := strings.Fields(r.Header.Get("Authorization")); len(fields) > 1 {
+		credential := strings.TrimPrefix(fields[1], "Credential=")
+		key = strings.Split(credential, "/")[0]
+		f.keys = append(f.keys, key)
+	}
+
+	action := r.PostForm.Get("Action")
+	roleARN := r.PostForm.Get("RoleArn")
+	role := roleARN[strings.LastIndex(roleARN, "/")+1:]
+
+	// Calls signed with a session token are chained
+	if r.Header.Get("X-Amz-Security-Token") != "" {
+		if duration, _ := strconv.Atoi(r.PostForm.Get("DurationSeconds")); duration > 3600 {
+			f.fail(w, "The requested DurationSeconds exceeds the 1 hour session limit for roles assumed by role chaining.")
+			return
+		}
+		for _, transitive := range f.transitive[key] {
+			for name, values := range r.PostForm {
+				if strings.HasPrefix(name, "Tags.member.") && strings.HasSuffix(name, ".Key") && values[0] == transitive {
+					f.fail(w, "Cannot override transitive tag "+transitive)
+					return
+				}
+			}
+		}
+	}
+	if f.transitive == nil {
+		f.transitive = map[string][]string{}
+	}
+	f.transitive[role] = append(f.transitive[key], r.PostForm["TransitiveTagKeys.member.1"]...)
+
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult>
+<Credentials><AccessKeyId>%s</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+<Expiration>%s</Expiration></Credentials>
+<AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>id</AssumedRoleId></AssumedRoleUser>
+</%[1]sResult></%[1]sResponse>`, action, role, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), roleARN)
+}
+
+func (f *fakeSTS) fail(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><Error><Type>Sender</Type>
+<Code>InvalidParameterValue</Code><Message>%s</Message></Error><RequestId>id</RequestId></ErrorResponse>`, message)
+}
+
+func newFakeSTSSession(t *testing.T, sts http.Handler) *session.Session {
+	srv := httptest.NewServer(sts)
+	t.Cleanup(srv.Close)
+
+	return session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("base", "secret", ""),
+	}))
+}
+
+func TestAssumeRoleChain(t *testing.T) {
+	sts := &fakeSTS{}
+	sess := chainRoles(newFakeSTSSession(t, sts), []config.ChainedRole{
+		{RoleARN: "arn:aws:iam::123456789012:role/hub", AssumeRole: config.AssumeRole{ExternalID: "s3cr3t"}},
+	})
+
+	creds := assumeRole(sess, "arn:aws:iam::210987654321:role/writer", "session", &config.AssumeRole{
+		Duration:          config.Duration(30 * time.Minute),
+		Policy:            `{"Version":"2012-10-17"}`,
+		PolicyARNs:        []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		Tags:              map[string]string{"team": "search", "env": "prod"},
+		TransitiveTagKeys: []string{"team"},
+		SourceIdentity:    "proxy",
+	})
+	v, err := creds.Get()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "writer", v.AccessKeyID)
+	assert.Equal(t, []string{"base", "hub"}, sts.keys)
+	if assert.Len(t, sts.calls, 2) {
+		assert.Equal(t, "arn:aws:iam::123456789012:role/hub", sts.calls[0].Get("RoleArn"))
+		assert.Equal(t, "s3cr3t", sts.calls[0].Get("ExternalId"))
+		assert.Equal(t, url.Values{
+			"Action":                     {"AssumeRole"},
+			"Version":                    {"2011-06-15"},
+			"RoleArn":                    {"arn:aws:iam::210987654321:role/writer"},
+			"RoleSessionName":            {"session"},
+			"DurationSeconds":            {"1800"},
+			"Policy":                     {`{"Version":"2012-10-17"}`},
+			"PolicyArns.member.1.arn":    {"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			"Tags.member.1.Key":          {"env"},
+			"Tags.member.1.Value":        {"prod"},
+			"Tags.member.2.Key":          {"team"},
+			"Tags.member.2.Value":        {"search"},
+			"TransitiveTagKeys.member.1": {"team"},
+			"SourceIdentity":             {"proxy"},
+		}, sts.calls[1])
+	}
+}
+
+func TestFlagRoleChain(t *testing.T) {
+	*roleArn = "arn:aws:iam::210987654321:role/writer"
+	*roleChain = []string{"arn:aws:iam::123456789012:role/hub"}
+	*roleExternalID = "s3cr3t"
+	*roleTags = map[string]string{"team": "search"}
+	*roleTransitiveTagKeys = []string{"team"}
+	*roleDuration = 2 * time.Hour
+	defer func() {
+		*roleArn, *roleChain, *roleExternalID, *roleTags, *roleTransitiveTagKeys, *roleDuration = "", nil, "", nil, nil, 0
+	}()
+
+	cfg, err := loadConfig()
+	assert.NoError(t, err)
+	route := cfg.Routes[0]
+
+	sts := &fakeSTS{}
+	creds := assumeRole(chainRoles(newFakeSTSSession(t, sts), route.RoleChain), route.RoleARN, "session", route.AssumeRole)
+	v, err := creds.Get()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "writer", v.AccessKeyID)
+	if assert.Len(t, sts.calls, 2) {
+		assert.Equal(t, "s3cr3t", sts.calls[0].Get("ExternalId"))
+		assert.Equal(t, "team", sts.calls[0].Get("TransitiveTagKeys.member.1"))
+		assert.Equal(t, "7200", sts.calls[0].Get("DurationSeconds"))
+		assert.Empty(t, sts.calls[1].Get("ExternalId"))
+		assert.Empty(t, sts.calls[1].Get("Tags.member.1.Key"))
+		assert.Equal(t, "900", sts.calls[1].Get("DurationSeconds"))
+	}
+	// The transitive tag reached the last role
+	assert.Equal(t, []string{"team"}, sts.transitive["writer"])
+}
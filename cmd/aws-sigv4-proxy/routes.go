@@ -0,0 +1,460 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"aws-sigv4-proxy/config"
+	"aws-sigv4-proxy/handler"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless/opensearchserverlessiface"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// clusterSettings keeps the _cluster/settings of every route, by name, across configuration reloads.
+var clusterSettings sync.Map
+
+var upstreamClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// loadConfig reads the --config file, or builds a single route from the command line flags.
+func loadConfig() (*config.Config, error) {
+	if *configFile != "" {
+		return config.Load(*configFile)
+	}
+
+	cfg := &config.Config{
+		Routes: []config.Route{
+			{
+				Name:         "default",
+				Upstream:     *hostOverride,
+				SigningName:  *signingNameOverride,
+				Region:       *regionOverride,
+				RoleARN:      *roleArn,
+				StripHeaders: *strip,
+			},
+		},
+	}
+	for principal, roleARN := range *roleMappings {
+		cfg.Routes[0].Roles = append(cfg.Routes[0].Roles, config.RoleMapping{
+			Name:       principal,
+			RoleARN:    roleARN,
+			Principals: []string{principal},
+		})
+	}
+	// Map iteration order is random, mappings are matched in order
+	sort.Slice(cfg.Routes[0].Roles, func(i, j int) bool { return cfg.Routes[0].Roles[i].Name < cfg.Routes[0].Roles[j].Name })
+
+	// The role options apply to the first role assumed, the first of the chain when there is one
+	opts := flagAssumeRole()
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid role options: %w", err)
+	}
+	cfg.Routes[0].RoleChain = flagRoleChain(opts)
+	if len(cfg.Routes[0].RoleChain) == 0 {
+		cfg.Routes[0].AssumeRole = opts
+	}
+
+	return cfg, nil
+}
+
+// buildRoutes compiles every route into its own ProxyClient and groups them by listen address,
+// along with the checks telling whether they are ready. Policies, when not nil, authorize the requests
+// of every route once its path prefix is stripped.
+func buildRoutes(sess *session.Session, cfg *config.Config, policies *config.Policies) (map[string][]handler.Route, []handler.ReadinessCheck) {
+	routes := map[string][]handler.Route{}
+	var checks []handler.ReadinessCheck
+	for _, route := range cfg.Routes {
+		listen := route.Listen
+		if listen == "" {
+			listen = *port
+		}
+
+		log.WithFields(log.Fields{
+			"route":        route.Name,
+			"listen":       listen,
+			"host":         route.Host,
+			"pathPrefix":   route.PathPrefix,
+			"upstream":     route.Upstream,
+			"StripHeaders": route.StripHeaders,
+		}).Infof("Routing %s", route.Name)
+
+		client := newProxyClient(sess, route)
+		routes[listen] = append(routes[listen], handler.Route{
+			Name:        route.Name,
+			Host:        route.Host,
+			PathPrefix:  route.PathPrefix,
+			StripPrefix: route.StripPrefix,
+			Handler:     authorize(policies, newRouteHandler(sess, route, client, newInfoHandler(cfg.Info, isElasticsearchCompat(route)))),
+		})
+		checks = append(checks, readinessChecks(route, client)...)
+	}
+
+	return routes, checks
+}
+
+// readinessChecks tell whether the credentials of a route can be retrieved and, when enabled, whether
+// its upstream accepts signed requests. Routes without an upstream proxy to the incoming Host and
+// have no upstream to check.
+func readinessChecks(route config.Route, client *handler.ProxyClient) []handler.ReadinessCheck {
+	checks := []handler.ReadinessCheck{
+		{Name: "credentials/" + route.Name, Check: client.CheckCredentials},
+	}
+
+	if *readinessCheckUpstream && route.Upstream != "" {
+		checks = append(checks, handler.ReadinessCheck{
+			Name: "upstream/" + route.Name,
+			Check: func(ctx context.Context) error {
+				return client.CheckUpstream(ctx, "", *readinessUpstreamPath)
+			},
+		})
+	}
+
+	return checks
+}
+
+// reloadRoutes swaps the routes of every listener for the ones compiled from cfg. Requests already
+// dispatched keep using the ProxyClient they started with.
+func reloadRoutes(sess *session.Session, cfg *config.Config, policies *config.Policies, routers map[string]*handler.Router, probes *handler.Probes) {
+	routes, checks := buildRoutes(sess, cfg, policies)
+	probes.SetChecks(checks)
+
+	for listen := range routes {
+		if _, ok := routers[listen]; !ok {
+			log.WithField("listen", listen).Error("Routes on a new listen address require a restart, ignoring them")
+		}
+	}
+
+	for listen, router := range routers {
+		if len(routes[listen]) == 0 {
+			log.WithField("listen", listen).Warn("No routes left on listen address, requests will be rejected")
+		}
+		router.SetRoutes(routes[listen])
+	}
+}
+
+func newProxyClient(sess *session.Session, route config.Route) *handler.ProxyClient {
+	if route.Region != "" {
+		sess = sess.Copy(&aws.Config{Region: aws.String(route.Region)})
+	}
+
+	sess = chainRoles(sess, route.RoleChain)
+
+	var creds *credentials.Credentials
+	if route.RoleARN != "" {
+		creds = assumeRole(sess, route.RoleARN, roleSessionName(), route.AssumeRole)
+	} else {
+		creds = sess.Config.Credentials
+	}
+
+	// Every role has its own credentials, cached until they expire, and a session name telling
+	// its clients apart in CloudTrail
+	var roles []handler.RoleSigner
+	for _, role := range route.Roles {
+		opts := role.AssumeRole
+		if opts == nil {
+			opts = route.AssumeRole
+		}
+		roles = append(roles, handler.RoleSigner{
+			Name:       role.Name,
+			RoleARN:    role.RoleARN,
+			Principals: role.Principals,
+			Signer:     newSigner(assumeRole(sess, role.RoleARN, clientSessionName(role.Name), opts)),
+		})
+	}
+
+	return &handler.ProxyClient{
+		Signer:              newSigner(creds),
+		Roles:               roles,
+		Client:              upstreamClient,
+		StripRequestHeaders: route.StripHeaders,
+		SigningNameOverride: route.SigningName,
+		HostOverride:        route.Upstream,
+		RegionOverride:      route.Region,
+		LogFailedRequest:    *logFailedResponse,
+		MaxBodySize:         int64(*maxBodySize),
+		MemoryBufferSize:    int64(*bodyBufferSize),
+		TempDir:             *bodyTempDir,
+		Retry:               retryPolicy(route.Retry),
+		ElasticsearchCompat: isElasticsearchCompat(route),
+		QueryRules:          queryRules(route),
+	}
+}
+
+func newSigner(creds *credentials.Credentials) *v4.Signer {
+	return v4.NewSigner(creds, func(s *v4.Signer) {
+		if shouldLogSigning() {
+			s.Logger = awsLoggerAdapter{}
+			s.Debug = aws.LogDebugWithSigning
+		}
+	})
+}
+
+// queryRules are the rules of the query profile of the route, or of the command line, followed by the
+// rules of the route. The auto profile picks aoss for routes signing for aoss or to a collection.
+func queryRules(route config.Route) []handler.QueryRule {
+	profile := *queryProfile
+	if route.QueryProfile != "" {
+		profile = route.QueryProfile
+	}
+	if profile == "auto" {
+		profile = "none"
+		if _, _, ok := handler.ParseCollectionHost(route.Upstream); ok || route.SigningName == "aoss" {
+			profile = "aoss"
+		}
+	}
+
+	var rules []handler.QueryRule
+	if profile == "aoss" {
+		rules = handler.AOSSQueryRules()
+	}
+	for _, rule := range route.QueryRules {
+		rules = append(rules, handler.QueryRule{
+			// Validated along with the configuration
+			Path:    regexp.MustCompile(rule.Path),
+			Methods: rule.Methods,
+			Drop:    rule.Drop,
+			Rewrite: rule.Rewrite,
+		})
+	}
+
+	return rules
+}
+
+// isElasticsearchCompat tells whether the route poses as Elasticsearch, the route setting wins over the flag.
+func isElasticsearchCompat(route config.Route) bool {
+	if route.ElasticsearchCompat != nil {
+		return *route.ElasticsearchCompat
+	}
+
+	return *elasticsearchCompat
+}
+
+// retryPolicy is the command line retry policy, with the fields set in override replaced.
+func retryPolicy(override *config.Retry) *handler.RetryPolicy {
+	policy := &handler.RetryPolicy{
+		MaxAttempts: *retryMaxAttempts,
+		BaseBackoff: *retryBaseBackoff,
+		MaxBackoff:  *retryMaxBackoff,
+		Jitter:      *retryJitter,
+		StatusCodes: *retryStatusCodes,
+		Methods:     *retryMethods,
+		APIs:        *retryAPIs,
+	}
+	if override == nil {
+		return policy
+	}
+
+	if override.MaxAttempts != 0 {
+		policy.MaxAttempts = override.MaxAttempts
+	}
+	if override.BaseBackoff != 0 {
+		policy.BaseBackoff = time.Duration(override.BaseBackoff)
+	}
+	if override.MaxBackoff != 0 {
+		policy.MaxBackoff = time.Duration(override.MaxBackoff)
+	}
+	if override.Jitter != nil {
+		policy.Jitter = *override.Jitter
+	}
+	if override.StatusCodes != nil {
+		policy.StatusCodes = override.StatusCodes
+	}
+	if override.Methods != nil {
+		policy.Methods = override.Methods
+	}
+	if override.APIs != nil {
+		policy.APIs = override.APIs
+	}
+
+	return policy
+}
+
+// bulkRetryPolicy is the route retry policy applied to _bulk items, nil when resubmitting failed
+// items is disabled.
+func bulkRetryPolicy(route config.Route, policy *handler.RetryPolicy) *handler.RetryPolicy {
+	bulk := *policy
+	bulk.MaxAttempts = *bulkRetryMaxAttempts
+	bulk.StatusCodes = *bulkRetryStatusCodes
+	if route.BulkRetry != nil {
+		if route.BulkRetry.MaxAttempts != 0 {
+			bulk.MaxAttempts = route.BulkRetry.MaxAttempts
+		}
+		if route.BulkRetry.StatusCodes != nil {
+			bulk.StatusCodes = route.BulkRetry.StatusCodes
+		}
+	}
+
+	if bulk.MaxAttempts <= 1 {
+		return nil
+	}
+
+	return &bulk
+}
+
+// newBulkHandler serves _bulk requests item by item when failed items are retried or large requests
+// split, and returns next otherwise.
+func newBulkHandler(route config.Route, client *handler.ProxyClient, next http.Handler) http.Handler {
+	bulk := &handler.BulkHandler{
+		Client:           client,
+		Next:             next,
+		Retry:            bulkRetryPolicy(route, client.Retry),
+		MaxChunkSize:     int64(*bulkSplitMaxSize),
+		MaxChunkItems:    *bulkSplitMaxItems,
+		Concurrency:      *bulkSplitConcurrency,
+		MaxBodySize:      client.MaxBodySize,
+		MemoryBufferSize: client.MemoryBufferSize,
+		TempDir:          client.TempDir,
+	}
+	if split := route.BulkSplit; split != nil {
+		if split.MaxSize != 0 {
+			bulk.MaxChunkSize = int64(split.MaxSize)
+		}
+		if split.MaxItems != 0 {
+			bulk.MaxChunkItems = split.MaxItems
+		}
+		if split.Concurrency != 0 {
+			bulk.Concurrency = split.Concurrency
+		}
+	}
+
+	if bulk.Retry == nil && bulk.MaxChunkSize <= 0 && bulk.MaxChunkItems <= 0 {
+		return next
+	}
+
+	return bulk
+}
+
+// newClusterHealth computes the health of the collection behind the route from its status as reported
+// by the control plane and a probe of the data plane, nil when the health is a static green.
+func newClusterHealth(sess *session.Session, route config.Route, client *handler.ProxyClient) *handler.ClusterHealth {
+	if *clusterHealthMode != "collection" {
+		return nil
+	}
+
+	health := &handler.ClusterHealth{
+		// The control plane of the region of each collection host, which may come from the Host of the client
+		Collections: func(region string) opensearchserverlessiface.OpenSearchServerlessAPI {
+			cfg := &aws.Config{Credentials: client.Signer.Credentials, Region: aws.String(region)}
+			if *clusterHealthEndpoint != "" {
+				cfg.Endpoint = clusterHealthEndpoint
+			}
+			return opensearchserverless.New(sess, cfg)
+		},
+		Host: route.Upstream,
+		TTL:  *clusterHealthTTL,
+	}
+	if *clusterHealthProbe {
+		health.Probe = func(ctx context.Context, host string) error {
+			return client.CheckUpstream(ctx, host, *readinessUpstreamPath)
+		}
+	}
+
+	return health
+}
+
+// newNoopHandlers answer _refresh and _forcemerge according to the policies of the route, or of the
+// command line. Emulating _forcemerge answers like faking it, AOSS merges segments on its own.
+func newNoopHandlers(route config.Route, client *handler.ProxyClient) (http.Handler, http.Handler) {
+	refresh := &handler.NoopHandler{API: "_refresh", Policy: *refreshPolicy, Fake: http.HandlerFunc(handler.RefreshAll)}
+	if route.RefreshPolicy != "" {
+		refresh.Policy = route.RefreshPolicy
+	}
+	emulator := &handler.RefreshEmulator{Client: client, Interval: *refreshInterval, Timeout: *refreshTimeout}
+	refresh.Emulate = emulator.Wait
+
+	forceMerge := &handler.NoopHandler{API: "_forcemerge", Policy: *forceMergePolicy, Fake: http.HandlerFunc(handler.ForceMerge)}
+	if route.ForceMergePolicy != "" {
+		forceMerge.Policy = route.ForceMergePolicy
+	}
+
+	return refresh, forceMerge
+}
+
+// newRouteHandler serves the intercepted endpoints and proxies everything else through client.
+func newRouteHandler(sess *session.Session, route config.Route, client *handler.ProxyClient, info http.Handler) http.Handler {
+	var health http.Handler = http.HandlerFunc(handler.GetHealthInfo)
+	cat := &handler.CatHandler{Client: client, Host: route.Upstream}
+	if collection := newClusterHealth(sess, route, client); collection != nil {
+		health = collection
+		cat.HealthStatus = collection.Status
+	}
+
+	stats := &handler.IndexStats{Client: client, Host: route.Upstream, TTL: *statsTTL}
+
+	router := mux.NewRouter()
+	router.Handle("/", info).Methods("GET")
+	router.HandleFunc("/_stats/{metrics}", handler.GetNodesInfo).Methods("GET")
+	router.HandleFunc("/_nodes/stats", handler.GetNodesInfo).Methods("GET")
+	router.HandleFunc("/_nodes/stats/{metrics}", handler.GetNodesInfo).Methods("GET")
+	router.Handle("/_all/_stats/_all", stats).Methods("GET") // not sure why this is not handled by the parameterized one.
+	router.Handle("/{index}/_stats", stats).Methods("GET")
+	router.Handle("/{index}/_stats/{metrics}", stats).Methods("GET")
+	router.HandleFunc("/_nodes/{node_id}", handler.GetNodesInfo).Methods("GET")
+	router.Handle("/_cluster/health", health).Methods("GET")
+	router.Handle("/_cluster/health/{index}", health).Methods("GET")
+	settings, _ := clusterSettings.LoadOrStore(route.Name, &handler.ClusterSettings{})
+	state := &handler.ClusterState{Client: client}
+	router.Handle("/_cluster/state", state).Methods("GET")
+	router.Handle("/_cluster/state/{metrics}", state).Methods("GET")
+	router.Handle("/_cluster/state/{metrics}/{indices}", state).Methods("GET")
+	router.Handle("/_cluster/settings", settings.(*handler.ClusterSettings)).Methods("GET", "PUT")
+	for _, api := range []string{"indices", "aliases", "count"} {
+		router.Handle("/_cat/"+api, cat).Methods("GET")
+		router.Handle("/_cat/"+api+"/{target}", cat).Methods("GET")
+	}
+	router.Handle("/_cat/health", cat).Methods("GET")
+	router.Handle("/_cat/nodes", cat).Methods("GET")
+	refresh, forceMerge := newNoopHandlers(route, client)
+	router.Handle("/_refresh", refresh).Methods("POST")
+	router.Handle("/{index}/_refresh", refresh).Methods("POST")
+	router.Handle("/_forcemerge", forceMerge).Methods("POST")
+	router.Handle("/{index}/_forcemerge", forceMerge).Methods("POST")
+	router.Use(handler.InstrumentIntercepted)
+
+	router.NotFoundHandler = &handler.Handler{
+		ProxyClient:   client,
+		FlushInterval: *flushInterval,
+	}
+	router.NotFoundHandler = &handler.RefreshWaiter{
+		Client:   client,
+		Next:     newBulkHandler(route, client, router.NotFoundHandler),
+		Interval: *refreshInterval,
+		Timeout:  *refreshTimeout,
+	}
+
+	if client.ElasticsearchCompat {
+		return handler.ElasticsearchProduct(router)
+	}
+
+	return router
+}
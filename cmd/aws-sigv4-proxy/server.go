@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// server is an http.Server counting the requests it is serving, to tell how many a shutdown cut off.
+type server struct {
+	*http.Server
+	inFlight int64
+}
+
+func newServer(addr string, h http.Handler) *server {
+	s := &server{}
+	s.Server = &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&s.inFlight, 1)
+			defer atomic.AddInt64(&s.inFlight, -1)
+			h.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+
+	return s
+}
+
+// serve listens until the server is shut down, reporting any other failure to errs.
+func (s *server) serve(errs chan<- error) {
+	if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		errs <- err
+	}
+}
+
+// drain stops every server from accepting connections and waits up to timeout for the requests
+// they are serving to complete, closing the connections of those still running afterwards.
+func drain(servers []*server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+
+			err := s.Shutdown(ctx)
+			if err == nil {
+				return
+			}
+
+			cutOff := atomic.LoadInt64(&s.inFlight)
+			s.Close()
+			log.WithError(err).
+				WithField("listen", s.Addr).
+				WithField("requests", cutOff).
+				Warnf("Drain timeout expired, cut off %d in-flight requests", cutOff)
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the proxy configuration file.
+type Config struct {
+	Routes []Route `json:"routes" yaml:"routes"`
+	// Info overrides what the proxy reports about the cluster on GET /.
+	Info *Info `json:"info" yaml:"info"`
+}
+
+// Info overrides the identity reported on GET /, fields left empty keep their default. Profiles
+// override it further for the clients whose User-Agent matches, the first matching one wins.
+type Info struct {
+	Identity `yaml:",inline"`
+	Profiles []InfoProfile `json:"profiles" yaml:"profiles"`
+}
+
+// InfoProfile is the identity reported to clients whose User-Agent matches the UserAgent regular expression.
+type InfoProfile struct {
+	Name      string `json:"name" yaml:"name"`
+	UserAgent string `json:"user_agent" yaml:"user_agent"`
+	Identity  `yaml:",inline"`
+}
+
+// Identity is what GET / reports about the cluster.
+type Identity struct {
+	NodeName    string  `json:"node_name" yaml:"node_name"`
+	ClusterName string  `json:"cluster_name" yaml:"cluster_name"`
+	ClusterUUID string  `json:"cluster_uuid" yaml:"cluster_uuid"`
+	TagLine     string  `json:"tag_line" yaml:"tag_line"`
+	Version     Version `json:"version" yaml:"version"`
+}
+
+// Version overrides the version block reported on GET /.
+type Version struct {
+	// Distribution is a pointer so that it can be set to empty, as Elasticsearch has none.
+	Distribution                     *string `json:"distribution" yaml:"distribution"`
+	Number                           string  `json:"number" yaml:"number"`
+	BuildFlavor                      string  `json:"build_flavor" yaml:"build_flavor"`
+	BuildType                        string  `json:"build_type" yaml:"build_type"`
+	BuildHash                        string  `json:"build_hash" yaml:"build_hash"`
+	BuildDate                        string  `json:"build_date" yaml:"build_date"`
+	LuceneVersion                    string  `json:"lucene_version" yaml:"lucene_version"`
+	MinimumWireCompatibilityVersion  string  `json:"minimum_wire_compatibility_version" yaml:"minimum_wire_compatibility_version"`
+	MinimumIndexCompatibilityVersion string  `json:"minimum_index_compatibility_version" yaml:"minimum_index_compatibility_version"`
+}
+
+// Route describes which incoming requests it matches and how they are signed and forwarded.
+type Route struct {
+	Name string `json:"name" yaml:"name"`
+
+	// Listen is the address the route is served on, the --port flag is used when empty.
+	Listen string `json:"listen" yaml:"listen"`
+	// Host matches the incoming Host header, any host matches when empty.
+	Host string `json:"host" yaml:"host"`
+	// PathPrefix matches the beginning of the request path, any path matches when empty.
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix"`
+	// StripPrefix removes PathPrefix from the path before the request is forwarded.
+	StripPrefix bool `json:"strip_prefix" yaml:"strip_prefix"`
+
+	// Upstream is the host to proxy to, the incoming Host header is used when empty.
+	Upstream     string   `json:"upstream" yaml:"upstream"`
+	SigningName  string   `json:"signing_name" yaml:"signing_name"`
+	Region       string   `json:"region" yaml:"region"`
+	RoleARN      string   `json:"role_arn" yaml:"role_arn"`
+	StripHeaders []string `json:"strip_headers" yaml:"strip_headers"`
+	// AssumeRole are the options RoleARN, and the roles without options of their own, are assumed with.
+	AssumeRole *AssumeRole `json:"assume_role" yaml:"assume_role"`
+	// RoleChain are the roles assumed in order before RoleARN and Roles, each with the credentials of
+	// the previous one.
+	RoleChain []ChainedRole `json:"role_chain" yaml:"role_chain"`
+	// Roles sign the requests of the clients mapped to them instead of RoleARN.
+	Roles []RoleMapping `json:"roles" yaml:"roles"`
+
+	// Retry overrides the retry policy given on the command line.
+	Retry *Retry `json:"retry" yaml:"retry"`
+	// BulkRetry overrides the _bulk item retry settings given on the command line.
+	BulkRetry *BulkRetry `json:"bulk_retry" yaml:"bulk_retry"`
+	// BulkSplit overrides the _bulk splitting settings given on the command line.
+	BulkSplit *BulkSplit `json:"bulk_split" yaml:"bulk_split"`
+	// RefreshPolicy and ForceMergePolicy override how _refresh and _forcemerge are answered, fake, error or emulate.
+	RefreshPolicy    string `json:"refresh_policy" yaml:"refresh_policy"`
+	ForceMergePolicy string `json:"forcemerge_policy" yaml:"forcemerge_policy"`
+	// QueryProfile overrides the built-in query parameter rules given on the command line, auto, aoss or none.
+	QueryProfile string `json:"query_profile" yaml:"query_profile"`
+	// QueryRules apply after the rules of the profile.
+	QueryRules []QueryRule `json:"query_rules" yaml:"query_rules"`
+	// ElasticsearchCompat overrides the Elasticsearch client compatibility mode given on the command line.
+	ElasticsearchCompat *bool `json:"elasticsearch_compat" yaml:"elasticsearch_compat"`
+}
+
+// RoleMapping signs the requests of its principals, or of the requests selecting it by name through the
+// trusted role header, with its own role.
+type RoleMapping struct {
+	Name       string      `json:"name" yaml:"name"`
+	RoleARN    string      `json:"role_arn" yaml:"role_arn"`
+	Principals []string    `json:"principals" yaml:"principals"`
+	AssumeRole *AssumeRole `json:"assume_role" yaml:"assume_role"`
+}
+
+// AssumeRole are the options of the STS AssumeRole calls of a role.
+type AssumeRole struct {
+	ExternalID string `json:"external_id" yaml:"external_id"`
+	// Duration of the credentials, the STS default of one hour is used when zero.
+	Duration Duration `json:"duration" yaml:"duration"`
+	// Policy is an inline session policy, a JSON document.
+	Policy     string   `json:"policy" yaml:"policy"`
+	PolicyARNs []string `json:"policy_arns" yaml:"policy_arns"`
+	// Tags are the session tags, TransitiveTagKeys the keys of those passed on to chained roles.
+	Tags              map[string]string `json:"tags" yaml:"tags"`
+	TransitiveTagKeys []string          `json:"transitive_tag_keys" yaml:"transitive_tag_keys"`
+	SourceIdentity    string            `json:"source_identity" yaml:"source_identity"`
+}
+
+// ChainedRole is a role assumed on the way to the role of a route.
+type ChainedRole struct {
+	RoleARN    string `json:"role_arn" yaml:"role_arn"`
+	AssumeRole `yaml:",inline"`
+}
+
+// Retry overrides the fields of the command line retry policy that are set.
+type Retry struct {
+	MaxAttempts int      `json:"max_attempts" yaml:"max_attempts"`
+	BaseBackoff Duration `json:"base_backoff" yaml:"base_backoff"`
+	MaxBackoff  Duration `json:"max_backoff" yaml:"max_backoff"`
+	Jitter      *float64 `json:"jitter" yaml:"jitter"`
+	StatusCodes []int    `json:"status_codes" yaml:"status_codes"`
+	Methods     []string `json:"methods" yaml:"methods"`
+	APIs        []string `json:"apis" yaml:"apis"`
+}
+
+// BulkRetry overrides the fields of the command line _bulk item retry settings that are set. Items
+// are retried with the backoff of the route retry policy.
+type BulkRetry struct {
+	MaxAttempts int   `json:"max_attempts" yaml:"max_attempts"`
+	StatusCodes []int `json:"status_codes" yaml:"status_codes"`
+}
+
+// BulkSplit overrides the fields of the command line _bulk splitting settings that are set.
+type BulkSplit struct {
+	MaxSize     ByteSize `json:"max_size" yaml:"max_size"`
+	MaxItems    int      `json:"max_items" yaml:"max_items"`
+	Concurrency int      `json:"concurrency" yaml:"concurrency"`
+}
+
+// QueryRule drops or rewrites the query parameters of the requests whose path matches the Path regular expression.
+type QueryRule struct {
+	Path    string            `json:"path" yaml:"path"`
+	Methods []string          `json:"methods" yaml:"methods"`
+	Drop    []string          `json:"drop" yaml:"drop"`
+	Rewrite map[string]string `json:"rewrite" yaml:"rewrite"`
+}
+
+// Load reads and validates a configuration file. Files with a .json extension are parsed
+// as JSON, anything else as YAML.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Parse(b, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse decodes and validates a configuration document.
+func Parse(b []byte, isJSON bool) (*Config, error) {
+	cfg := &Config{}
+
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration for mistakes and names unnamed routes after their position.
+func (c *Config) Validate() error {
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("at least one route is required")
+	}
+
+	names := map[string]bool{}
+	for i := range c.Routes {
+		route := &c.Routes[i]
+
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if names[route.Name] {
+			return fmt.Errorf("route %s: duplicate route name", route.Name)
+		}
+		names[route.Name] = true
+
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("route %s: path_prefix must start with /", route.Name)
+		}
+		if route.StripPrefix && route.PathPrefix == "" {
+			return fmt.Errorf("route %s: strip_prefix requires a path_prefix", route.Name)
+		}
+		if (route.SigningName == "") != (route.Region == "") {
+			return fmt.Errorf("route %s: signing_name and region must be set together", route.Name)
+		}
+		if !validNoopPolicy(route.RefreshPolicy) {
+			return fmt.Errorf("route %s: refresh_policy must be fake, error or emulate", route.Name)
+		}
+		if !validNoopPolicy(route.ForceMergePolicy) {
+			return fmt.Errorf("route %s: forcemerge_policy must be fake, error or emulate", route.Name)
+		}
+		switch route.QueryProfile {
+		case "", "auto", "aoss", "none":
+		default:
+			return fmt.Errorf("route %s: query_profile must be auto, aoss or none", route.Name)
+		}
+		for j, rule := range route.QueryRules {
+			if rule.Path == "" {
+				return fmt.Errorf("route %s: query rule %d: path is required", route.Name, j)
+			}
+			if _, err := regexp.Compile(rule.Path); err != nil {
+				return fmt.Errorf("route %s: query rule %d: invalid path: %w", route.Name, j, err)
+			}
+		}
+		if err := route.AssumeRole.Validate(); err != nil {
+			return fmt.Errorf("route %s: assume_role: %w", route.Name, err)
+		}
+		for j, role := range route.RoleChain {
+			if role.RoleARN == "" {
+				return fmt.Errorf("route %s: role_chain %d: role_arn is required", route.Name, j)
+			}
+			if err := role.AssumeRole.Validate(); err != nil {
+				return fmt.Errorf("route %s: role_chain %d: %w", route.Name, j, err)
+			}
+		}
+		roles := map[string]bool{}
+		for j, role := range route.Roles {
+			if role.Name == "" {
+				return fmt.Errorf("route %s: role %d: name is required", route.Name, j)
+			}
+			if roles[role.Name] {
+				return fmt.Errorf("route %s: role %s: duplicate role name", route.Name, role.Name)
+			}
+			roles[role.Name] = true
+			if role.RoleARN == "" {
+				return fmt.Errorf("route %s: role %s: role_arn is required", route.Name, role.Name)
+			}
+			if err := role.AssumeRole.Validate(); err != nil {
+				return fmt.Errorf("route %s: role %s: assume_role: %w", route.Name, role.Name, err)
+			}
+		}
+		if route.Retry != nil && route.Retry.Jitter != nil && (*route.Retry.Jitter < 0 || *route.Retry.Jitter > 1) {
+			return fmt.Errorf("route %s: retry jitter must be between 0 and 1", route.Name)
+		}
+	}
+
+	if c.Info != nil {
+		for i := range c.Info.Profiles {
+			profile := &c.Info.Profiles[i]
+			if profile.Name == "" {
+				profile.Name = fmt.Sprintf("profile-%d", i)
+			}
+			if profile.UserAgent == "" {
+				return fmt.Errorf("info profile %s: user_agent is required", profile.Name)
+			}
+			if _, err := regexp.Compile(profile.UserAgent); err != nil {
+				return fmt.Errorf("info profile %s: invalid user_agent: %w", profile.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the options for mistakes STS would only report when the role is assumed.
+func (a *AssumeRole) Validate() error {
+	if a == nil {
+		return nil
+	}
+
+	// STS accepts durations from 15 minutes up to the maximum session duration of the role, 12 hours at most
+	if a.Duration != 0 && (time.Duration(a.Duration) < 15*time.Minute || time.Duration(a.Duration) > 12*time.Hour) {
+		return fmt.Errorf("duration must be between 15m and 12h")
+	}
+	if a.Policy != "" && !json.Valid([]byte(a.Policy)) {
+		return fmt.Errorf("policy must be a JSON document")
+	}
+	for _, key := range a.TransitiveTagKeys {
+		if _, ok := a.Tags[key]; !ok {
+			return fmt.Errorf("transitive tag key %s is not a tag", key)
+		}
+	}
+	if a.SourceIdentity != "" && (len(a.SourceIdentity) < 2 || len(a.SourceIdentity) > 64) {
+		return fmt.Errorf("source_identity must be 2 to 64 characters long")
+	}
+
+	return nil
+}
+
+func validNoopPolicy(policy string) bool {
+	switch policy {
+	case "", "fake", "error", "emulate":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		want     *Config
+		err      error
+	}{
+		{
+			name:     "should parse yaml routes",
+			filename: "config.yaml",
+			content: `
+routes:
+  - name: logs
+    listen: ":9200"
+    host: logs.local
+    upstream: abcdefgh.us-east-1.aoss.amazonaws.com
+    signing_name: aoss
+    region: us-east-1
+    role_arn: arn:aws:iam::123456789012:role/logs
+    strip_headers: [Authorization]
+  - path_prefix: /aps
+    strip_prefix: true
+    upstream: aps-workspaces.us-east-1.amazonaws.com
+`,
+			want: &Config{
+				Routes: []Route{
+					{
+						Name:         "logs",
+						Listen:       ":9200",
+						Host:         "logs.local",
+						Upstream:     "abcdefgh.us-east-1.aoss.amazonaws.com",
+						SigningName:  "aoss",
+						Region:       "us-east-1",
+						RoleARN:      "arn:aws:iam::123456789012:role/logs",
+						StripHeaders: []string{"Authorization"},
+					},
+					{
+						Name:        "route-1",
+						PathPrefix:  "/aps",
+						StripPrefix: true,
+						Upstream:    "aps-workspaces.us-east-1.amazonaws.com",
+					},
+				},
+			},
+		},
+		{
+			name:     "should parse json routes",
+			filename: "config.json",
+			content:  "{\n\t\"routes\": [{\"name\": \"es\", \"upstream\": \"search.us-east-1.es.amazonaws.com\"}]\n}",
+			want: &Config{
+				Routes: []Route{
+					{Name: "es", Upstream: "search.us-east-1.es.amazonaws.com"},
+				},
+			},
+		},
+		{
+			name:     "should parse role chains and assume role options",
+			filename: "config.yaml",
+			content: `
+routes:
+  - name: central
+    role_arn: arn:aws:iam::210987654321:role/logs-writer
+    assume_role:
+      duration: 30m
+      tags: {team: search, env: prod}
+      transitive_tag_keys: [team]
+      source_identity: proxy
+    role_chain:
+      - role_arn: arn:aws:iam::123456789012:role/hub
+        external_id: s3cr3t
+        policy_arns: [arn:aws:iam::aws:policy/ReadOnlyAccess]
+`,
+			want: &Config{
+				Routes: []Route{
+					{
+						Name:    "central",
+						RoleARN: "arn:aws:iam::210987654321:role/logs-writer",
+						AssumeRole: &AssumeRole{
+							Duration:          Duration(30 * time.Minute),
+							Tags:              map[string]string{"team": "search", "env": "prod"},
+							TransitiveTagKeys: []string{"team"},
+							SourceIdentity:    "proxy",
+						},
+						RoleChain: []ChainedRole{
+							{
+								RoleARN: "arn:aws:iam::123456789012:role/hub",
+								AssumeRole: AssumeRole{
+									ExternalID: "s3cr3t",
+									PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:     "should reject transitive tag keys that are not tags",
+			filename: "config.yaml",
+			content:  "routes:\n  - role_arn: arn\n    assume_role:\n      transitive_tag_keys: [team]\n",
+			err:      fmt.Errorf("route route-0: assume_role: transitive tag key team is not a tag"),
+		},
+		{
+			name:     "should reject durations STS does not accept",
+			filename: "config.yaml",
+			content:  "routes:\n  - role_chain:\n      - role_arn: arn\n        duration: 5m\n",
+			err:      fmt.Errorf("route route-0: role_chain 0: duration must be between 15m and 12h"),
+		},
+		{
+			name:     "should reject unknown fields",
+			filename: "config.json",
+			content:  `{"routes": [{"hots": "typo"}]}`,
+			err:      fmt.Errorf(`json: unknown field "hots"`),
+		},
+		{
+			name:     "should require routes",
+			filename: "config.yaml",
+			content:  `routes: []`,
+			err:      fmt.Errorf("at least one route is required"),
+		},
+		{
+			name:     "should reject duplicate route names",
+			filename: "config.yaml",
+			content:  "routes:\n  - name: a\n  - name: a\n",
+			err:      fmt.Errorf("route a: duplicate route name"),
+		},
+		{
+			name:     "should reject relative path prefixes",
+			filename: "config.yaml",
+			content:  "routes:\n  - path_prefix: logs\n",
+			err:      fmt.Errorf("route route-0: path_prefix must start with /"),
+		},
+		{
+			name:     "should require role ARNs of role mappings",
+			filename: "config.yaml",
+			content:  "routes:\n  - roles:\n      - name: ingest\n        principals: [fluent-bit]\n",
+			err:      fmt.Errorf("route route-0: role ingest: role_arn is required"),
+		},
+		{
+			name:     "should require signing name and region together",
+			filename: "config.yaml",
+			content:  "routes:\n  - signing_name: aoss\n",
+			err:      fmt.Errorf("route route-0: signing_name and region must be set together"),
+		},
+		{
+			name:     "should reject invalid query rule paths",
+			filename: "config.yaml",
+			content:  "routes:\n  - query_rules: [{path: \"(\", drop: [timeout]}]\n",
+			err:      fmt.Errorf("route route-0: query rule 0: invalid path: error parsing regexp: missing closing ): `(`"),
+		},
+		{
+			name:     "should reject unknown refresh policies",
+			filename: "config.yaml",
+			content:  "routes:\n  - refresh_policy: wait\n",
+			err:      fmt.Errorf("route route-0: refresh_policy must be fake, error or emulate"),
+		},
+		{
+			name:     "should parse retry overrides",
+			filename: "config.yaml",
+			content:  "routes:\n  - retry:\n      max_attempts: 3\n      base_backoff: 250ms\n      status_codes: [429]\n",
+			want: &Config{
+				Routes: []Route{
+					{
+						Name: "route-0",
+						Retry: &Retry{
+							MaxAttempts: 3,
+							BaseBackoff: Duration(250 * time.Millisecond),
+							StatusCodes: []int{429},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:     "should parse bulk split sizes",
+			filename: "config.yaml",
+			content:  "routes:\n  - name: a\n    bulk_split: {max_size: 9MiB}\n  - name: b\n    bulk_split: {max_size: 1024, max_items: 500}\n",
+			want: &Config{
+				Routes: []Route{
+					{Name: "a", BulkSplit: &BulkSplit{MaxSize: 9 << 20}},
+					{Name: "b", BulkSplit: &BulkSplit{MaxSize: 1024, MaxItems: 500}},
+				},
+			},
+		},
+		{
+			name:     "should parse info profiles",
+			filename: "config.yaml",
+			content: `
+routes:
+  - name: logs
+info:
+  cluster_name: logs
+  version:
+    number: 2.5.0
+  profiles:
+    - name: elasticsearch-py
+      user_agent: ^elasticsearch-py/7
+      tag_line: You Know, for Search
+      version:
+        number: 7.10.2
+`,
+			want: &Config{
+				Routes: []Route{{Name: "logs"}},
+				Info: &Info{
+					Identity: Identity{ClusterName: "logs", Version: Version{Number: "2.5.0"}},
+					Profiles: []InfoProfile{
+						{
+							Name:      "elasticsearch-py",
+							UserAgent: "^elasticsearch-py/7",
+							Identity:  Identity{TagLine: "You Know, for Search", Version: Version{Number: "7.10.2"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:     "should reject invalid user agent patterns",
+			filename: "config.json",
+			content:  `{"routes": [{}], "info": {"profiles": [{"user_agent": "(", "version": {"number": "7.10.2"}}]}}`,
+			err:      fmt.Errorf("info profile profile-0: invalid user_agent: error parsing regexp: missing closing ): `(`"),
+		},
+		{
+			name:     "should reject invalid retry durations",
+			filename: "config.json",
+			content:  `{"routes": [{"retry": {"max_backoff": "soon"}}]}`,
+			err:      fmt.Errorf(`time: invalid duration "soon"`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.filename)
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			cfg, err := Load(path)
+
+			assert.Equal(t, tt.want, cfg)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, fmt.Sprintf("invalid configuration file %s: %v", path, tt.err))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policies is the content of the authorization policy file.
+type Policies struct {
+	Policies []Policy `json:"policies" yaml:"policies"`
+}
+
+// Policy allows the principals it names the operations on the indices matching its patterns.
+type Policy struct {
+	Name string `json:"name" yaml:"name"`
+	// Principals are principal names, group:<name> for the members of a group, or * for anyone.
+	Principals []string `json:"principals" yaml:"principals"`
+	// Indices are index names, where * matches any characters.
+	Indices []string `json:"indices" yaml:"indices"`
+	// Operations are read, write, delete, admin, or * for all of them.
+	Operations []string `json:"operations" yaml:"operations"`
+}
+
+// LoadPolicies reads and validates an authorization policy file. Files with a .json extension are
+// parsed as JSON, anything else as YAML.
+func LoadPolicies(path string) (*Policies, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := &Policies{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(policies)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(policies)
+	}
+	if err == nil {
+		err = policies.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	return policies, nil
+}
+
+// Validate checks the policies for mistakes and names unnamed policies after their position.
+func (p *Policies) Validate() error {
+	for i := range p.Policies {
+		policy := &p.Policies[i]
+
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("policy-%d", i)
+		}
+		if len(policy.Principals) == 0 {
+			return fmt.Errorf("policy %s: at least one principal is required", policy.Name)
+		}
+		if len(policy.Indices) == 0 {
+			return fmt.Errorf("policy %s: at least one index is required", policy.Name)
+		}
+		for _, index := range policy.Indices {
+			if index == "" || strings.ContainsAny(index, "?[\\,") {
+				return fmt.Errorf("policy %s: invalid index %q, only * is supported as a wildcard", policy.Name, index)
+			}
+		}
+		if len(policy.Operations) == 0 {
+			return fmt.Errorf("policy %s: at least one operation is required", policy.Name)
+		}
+		for _, operation := range policy.Operations {
+			switch operation {
+			case "read", "write", "delete", "admin", "*":
+			default:
+				return fmt.Errorf("policy %s: operation %q must be read, write, delete, admin or *", policy.Name, operation)
+			}
+		}
+	}
+
+	return nil
+}
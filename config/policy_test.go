@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		want     *Policies
+		err      error
+	}{
+		{
+			name:     "should parse yaml policies",
+			filename: "policies.yaml",
+			content: `
+policies:
+  - name: ingest
+    principals: [fluent-bit]
+    indices: ["logs-*"]
+    operations: [write]
+  - principals: ["group:analysts"]
+    indices: ["logs-*", metrics]
+    operations: [read]
+`,
+			want: &Policies{Policies: []Policy{
+				{Name: "ingest", Principals: []string{"fluent-bit"}, Indices: []string{"logs-*"}, Operations: []string{"write"}},
+				{Name: "policy-1", Principals: []string{"group:analysts"}, Indices: []string{"logs-*", "metrics"}, Operations: []string{"read"}},
+			}},
+		},
+		{
+			name:     "should parse json policies",
+			filename: "policies.json",
+			content:  `{"policies": [{"name": "admins", "principals": ["*"], "indices": ["*"], "operations": ["*"]}]}`,
+			want: &Policies{Policies: []Policy{
+				{Name: "admins", Principals: []string{"*"}, Indices: []string{"*"}, Operations: []string{"*"}},
+			}},
+		},
+		{
+			name:     "should reject unknown operations",
+			filename: "policies.yaml",
+			content:  "policies:\n  - principals: [a]\n    indices: [b]\n    operations: [manage]\n",
+			err:      fmt.Errorf(`policy policy-0: operation "manage" must be read, write, delete, admin or *`),
+		},
+		{
+			name:     "should reject unsupported wildcards",
+			filename: "policies.yaml",
+			content:  "policies:\n  - principals: [a]\n    indices: [\"logs-?\"]\n    operations: [read]\n",
+			err:      fmt.Errorf(`policy policy-0: invalid index "logs-?", only * is supported as a wildcard`),
+		},
+		{
+			name:     "should require principals",
+			filename: "policies.yaml",
+			content:  "policies:\n  - name: nobody\n    indices: [b]\n    operations: [read]\n",
+			err:      fmt.Errorf("policy nobody: at least one principal is required"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.filename)
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			policies, err := LoadPolicies(path)
+
+			assert.Equal(t, tt.want, policies)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, fmt.Sprintf("invalid policy file %s: %v", path, tt.err))
+			}
+		})
+	}
+}
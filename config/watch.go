@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Watch calls onChange with the new configuration whenever the content of the file at path changes.
+// The file is checked every interval, zero disables polling, and unconditionally whenever reload
+// receives a value. Files failing to load are logged and otherwise ignored, leaving the current
+// configuration in place. Watch returns once ctx is done.
+//
+// Polling the content rather than relying on file system events keeps working when the file is a
+// symlink being swapped, as Kubernetes does for mounted ConfigMaps.
+func Watch(ctx context.Context, path string, interval time.Duration, reload <-chan os.Signal, onChange func(*Config)) {
+	current := fileDigest(path)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			force = true
+		case <-tick:
+		}
+
+		digest := fileDigest(path)
+		if !force && bytes.Equal(digest, current) {
+			continue
+		}
+
+		cfg, err := Load(path)
+		if err != nil {
+			log.WithError(err).Error("unable to reload configuration, keeping the current one")
+			current = digest
+			continue
+		}
+
+		log.WithField("config", path).Info("Reloading configuration")
+		current = digest
+		onChange(cfg)
+	}
+}
+
+func fileDigest(path string) []byte {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
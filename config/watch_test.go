@@ -0,0 +1,62 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - name: first\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reload := make(chan os.Signal)
+	changes := make(chan *Config)
+	go Watch(ctx, path, 10*time.Millisecond, reload, func(cfg *Config) {
+		changes <- cfg
+	})
+
+	next := func() string {
+		select {
+		case cfg := <-changes:
+			return cfg.Routes[0].Name
+		case <-time.After(time.Second):
+			return "timed out"
+		}
+	}
+
+	// Forcing a reload also ensures the watcher is running before the file changes
+	reload <- syscall.SIGHUP
+	assert.Equal(t, "first", next())
+
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - name: second\n"), 0600))
+	assert.Equal(t, "second", next())
+
+	// An invalid file is ignored until it is fixed
+	assert.NoError(t, os.WriteFile(path, []byte("routes: []\n"), 0600))
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - name: third\n"), 0600))
+	assert.Equal(t, "third", next())
+}
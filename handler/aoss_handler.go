@@ -1,18 +1,29 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Version struct {
-	Distribution                     string `json:"distribution"`
+	Distribution                     string `json:"distribution,omitempty"`
 	Number                           string `json:"number"`
 	BuildType                        string `json:"build_type"`
 	BuildHash                        string `json:"build_hash"`
 	BuildDate                        string `json:"build_date"`
 	BuildSnapshot                    bool   `json:"build_snapshot"`
+	BuildFlavor                      string `json:"build_flavor,omitempty"`
 	LuceneVersion                    string `json:"lucene_version"`
 	MinimumWireCompatibilityVersion  string `json:"minimum_wire_compatibility_version"`
 	MinimumIndexCompatibilityVersion string `json:"minimum_index_compatibility_version"`
@@ -31,6 +42,11 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 		log.Debug("Intercepted /")
 	}
 
+	writeInfo(w, DefaultInfo())
+}
+
+// DefaultInfo is what GetInfo reports about the cluster.
+func DefaultInfo() Info {
 	version := Version{
 		Distribution:                     "aoss",
 		Number:                           "2.3.0",
@@ -42,27 +58,48 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 		MinimumWireCompatibilityVersion:  "7.10.0",
 		MinimumIndexCompatibilityVersion: "7.0.0",
 	}
-	info := Info{
+	return Info{
 		Name:        "serverless",
 		ClusterName: "serverless",
 		ClusterUuid: "0",
 		Version:     version,
 		TagLine:     "The OpenSearch Project: https://opensearch.org/",
 	}
+}
 
+func writeInfo(w http.ResponseWriter, info Info) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	err := json.NewEncoder(w).Encode(info)
 	if err != nil {
 		println("Could not encode info details")
 	}
+}
 
-	//b, error := json.MarshalIndent(info, "", "  ")
-	//if error != nil {
-	//	log.Println("JSON parse error: ", error)
-	//	return
-	//}
-	//
-	//log.Println(string(b))
+// InfoProfile is the Info reported to clients whose User-Agent matches.
+type InfoProfile struct {
+	Name      string
+	UserAgent *regexp.Regexp
+	Info      Info
+}
+
+// InfoHandler answers GET / like GetInfo, with the identity given by the first profile matching
+// the client User-Agent, or Info. Some clients only connect to the versions they expect.
+type InfoHandler struct {
+	Info     Info
+	Profiles []InfoProfile
+}
+
+func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info := h.Info
+	for _, profile := range h.Profiles {
+		if profile.UserAgent.MatchString(r.UserAgent()) {
+			log.WithField("profile", profile.Name).WithField("user_agent", r.UserAgent()).Debug("Intercepted /")
+			info = profile.Info
+			break
+		}
+	}
+
+	writeInfo(w, info)
 }
 
 type Os struct {
@@ -189,9 +226,13 @@ func GetHealthInfo(w http.ResponseWriter, r *http.Request) {
 		log.Debug("Intercepted _cluster/health")
 	}
 
-	health := Health{
+	writeHealth(w, newHealth("green"))
+}
+
+func newHealth(status string) Health {
+	return Health{
 		ClusterName:                 "serverless",
-		Status:                      "green",
+		Status:                      status,
 		TimedOut:                    false,
 		NumberOfNodes:               1,
 		NumberOfDataNodes:           1,
@@ -206,7 +247,9 @@ func GetHealthInfo(w http.ResponseWriter, r *http.Request) {
 		TaskMaxWaitingInQueueMillis: 0,
 		ActiveShardsPercentAsNumber: 1.0,
 	}
+}
 
+func writeHealth(w http.ResponseWriter, health Health) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	err := json.NewEncoder(w).Encode(health)
 	if err != nil {
@@ -248,14 +291,569 @@ func ForceMerge(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func GetIndexStats(w http.ResponseWriter, r *http.Request) {
+// Policies of the endpoints AOSS has no use for, such as _refresh.
+const (
+	// NoopFake answers with a made up success, as if the call had been made.
+	NoopFake = "fake"
+	// NoopError answers with an illegal_argument_exception.
+	NoopError = "error"
+	// NoopEmulate waits for the effect of the call before answering like NoopFake.
+	NoopEmulate = "emulate"
+)
 
-	shards := Shards{Total: 1, Successful: 1, Failed: 0}
-	result := ShardsResults{Shards: shards}
+// NoopHandler answers an endpoint AOSS has no use for according to Policy, without forwarding it.
+// Requests are logged at info level, for users to know they were short-circuited.
+type NoopHandler struct {
+	// API names the endpoint, such as _refresh.
+	API    string
+	Policy string
+	// Fake writes the made up success.
+	Fake http.Handler
+	// Emulate waits for the effect of the call, nil answers like NoopFake.
+	Emulate func(r *http.Request) error
+}
+
+func (h *NoopHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{"path": r.URL.Path, "policy": h.Policy}).Infof("Intercepted %s, not forwarded to upstream", h.API)
+
+	switch h.Policy {
+	case NoopError:
+		writeOpenSearchError(w, http.StatusBadRequest, "illegal_argument_exception", h.API+" is not supported by OpenSearch Serverless")
+		return
+	case NoopEmulate:
+		if h.Emulate != nil {
+			if err := h.Emulate(r); err != nil {
+				writeUpstreamError(w, err)
+				return
+			}
+		}
+	}
+
+	h.Fake.ServeHTTP(w, r)
+}
+
+// RefreshEmulator waits for the documents of an index to become searchable, by counting them every
+// Interval until the count stops changing, or Timeout expires.
+type RefreshEmulator struct {
+	Client   Client
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Wait waits for the documents of the index of a /{index}/_refresh request, or of every index, to
+// become searchable.
+func (e *RefreshEmulator) Wait(r *http.Request) error {
+	target := ""
+	if segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(segments) > 1 {
+		target = segments[0]
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.Timeout)
+	defer cancel()
+
+	previous := int64(-1)
+	for {
+		var count struct {
+			Count int64 `json:"count"`
+		}
+		err := getJSON(ctx, e.Client, r.Host, indexPath(target, "_count"), &count)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil && count.Count == previous {
+			log.WithFields(log.Fields{"index": target, "count": count.Count}).Debug("document count is stable")
+			return nil
+		}
+		previous = count.Count
+
+		select {
+		case <-ctx.Done():
+			if r.Context().Err() != nil {
+				return r.Context().Err()
+			}
+			log.WithFields(log.Fields{"index": target, "timeout": e.Timeout}).Warn("document count still changing, answering _refresh anyway")
+			return nil
+		case <-time.After(e.Interval):
+		}
+	}
+}
+
+// ClusterState answers _cluster/state with the metadata of the indices, assembled from their mappings
+// and aliases upstream. The other metrics are made up like _nodes.
+type ClusterState struct {
+	Client Client
+}
+
+type IndexMetadata struct {
+	State    string                     `json:"state"`
+	Settings map[string]interface{}     `json:"settings"`
+	Mappings map[string]json.RawMessage `json:"mappings"`
+	Aliases  []string                   `json:"aliases"`
+}
+
+type Metadata struct {
+	ClusterUuid string                   `json:"cluster_uuid"`
+	Templates   map[string]interface{}   `json:"templates"`
+	Indices     map[string]IndexMetadata `json:"indices"`
+}
+
+type ClusterStateNode struct {
+	Name             string `json:"name"`
+	EphemeralId      string `json:"ephemeral_id"`
+	TransportAddress string `json:"transport_address"`
+}
+
+type State struct {
+	ClusterName        string                      `json:"cluster_name"`
+	ClusterUuid        string                      `json:"cluster_uuid"`
+	Version            *int64                      `json:"version,omitempty"`
+	StateUuid          string                      `json:"state_uuid,omitempty"`
+	MasterNode         string                      `json:"master_node,omitempty"`
+	ClusterManagerNode string                      `json:"cluster_manager_node,omitempty"`
+	Nodes              map[string]ClusterStateNode `json:"nodes,omitempty"`
+	Metadata           *Metadata                   `json:"metadata,omitempty"`
+}
+
+func (h *ClusterState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if log.GetLevel() == log.DebugLevel {
+		log.Debug("Intercepted _cluster/state")
+	}
+
+	// _cluster/state/{metrics}/{indices}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	metrics := map[string]bool{"_all": true}
+	if len(segments) > 2 {
+		metrics = map[string]bool{}
+		for _, metric := range strings.Split(segments[2], ",") {
+			metrics[metric] = true
+		}
+	}
+	indices := ""
+	if len(segments) > 3 {
+		indices = segments[3]
+	}
+
+	state := State{ClusterName: "serverless", ClusterUuid: "0"}
+	if metrics["_all"] || metrics["version"] {
+		version := int64(1)
+		state.Version = &version
+		state.StateUuid = "0"
+	}
+	if metrics["_all"] || metrics["master_node"] || metrics["cluster_manager_node"] {
+		state.MasterNode = "abcdefgh"
+		state.ClusterManagerNode = "abcdefgh"
+	}
+	if metrics["_all"] || metrics["nodes"] {
+		state.Nodes = map[string]ClusterStateNode{
+			"abcdefgh": {Name: "node", EphemeralId: "abcdefgh", TransportAddress: "127.0.0.1:9300"},
+		}
+	}
+	if metrics["_all"] || metrics["metadata"] {
+		metadata, err := h.metadata(r, indices)
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		state.Metadata = metadata
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(state)
+	if err != nil {
+		log.WithError(err).Warn("unable to encode _cluster/state response")
+	}
+}
+
+// metadata describes the indices matching the comma separated patterns of indices, all of them when empty.
+func (h *ClusterState) metadata(r *http.Request, indices string) (*Metadata, error) {
+	var mappings map[string]struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}
+	if err := getJSON(r.Context(), h.Client, r.Host, indexPath(indices, "_mapping"), &mappings); err != nil {
+		return nil, err
+	}
+
+	var aliases map[string]struct {
+		Aliases map[string]json.RawMessage `json:"aliases"`
+	}
+	if err := getJSON(r.Context(), h.Client, r.Host, indexPath(indices, "_alias"), &aliases); err != nil {
+		return nil, err
+	}
+
+	metadata := &Metadata{ClusterUuid: "0", Templates: map[string]interface{}{}, Indices: map[string]IndexMetadata{}}
+	for name, mapping := range mappings {
+		index := IndexMetadata{
+			State: "open",
+			Settings: map[string]interface{}{
+				"index": map[string]string{
+					"number_of_shards":   "1",
+					"number_of_replicas": "0",
+					"provided_name":      name,
+					"uuid":               "_na_",
+				},
+			},
+			Mappings: map[string]json.RawMessage{},
+			Aliases:  []string{},
+		}
+		// Cluster state nests mappings under their type, as in Elasticsearch 7
+		if len(mapping.Mappings) > 0 && string(mapping.Mappings) != "{}" {
+			index.Mappings["_doc"] = mapping.Mappings
+		}
+		for alias := range aliases[name].Aliases {
+			index.Aliases = append(index.Aliases, alias)
+		}
+		sort.Strings(index.Aliases)
+		metadata.Indices[name] = index
+	}
+
+	return metadata, nil
+}
+
+// ClusterSettings answers GET and PUT _cluster/settings from settings kept in memory, so that tools
+// updating cluster settings on startup get their settings echoed back. Nothing is sent upstream.
+type ClusterSettings struct {
+	mu         sync.Mutex
+	persistent map[string]interface{}
+	transient  map[string]interface{}
+}
 
+type settingsUpdate struct {
+	Persistent map[string]interface{} `json:"persistent"`
+	Transient  map[string]interface{} `json:"transient"`
+}
+
+func (h *ClusterSettings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithField("method", r.Method).Debug("Intercepted _cluster/settings")
+
+	flat := r.URL.Query().Get("flat_settings") == "true"
+
+	switch r.Method {
+	case http.MethodGet:
+		h.mu.Lock()
+		result := map[string]interface{}{
+			"persistent": formatSettings(h.persistent, flat),
+			"transient":  formatSettings(h.transient, flat),
+		}
+		h.mu.Unlock()
+		writeSettings(w, http.StatusOK, result)
+
+	case http.MethodPut:
+		var update settingsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("%v - %v", "invalid cluster settings", err), http.StatusBadRequest)
+			return
+		}
+
+		persistent, transient := flattenSettings(update.Persistent), flattenSettings(update.Transient)
+		h.mu.Lock()
+		h.persistent = applySettings(h.persistent, persistent)
+		h.transient = applySettings(h.transient, transient)
+		h.mu.Unlock()
+
+		writeSettings(w, http.StatusOK, map[string]interface{}{
+			"acknowledged": true,
+			"persistent":   formatSettings(persistent, flat),
+			"transient":    formatSettings(transient, flat),
+		})
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, fmt.Sprintf("%v - %v", "method not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSettings(w http.ResponseWriter, status int, result map[string]interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 	err := json.NewEncoder(w).Encode(result)
 	if err != nil {
-		println("Could not encode info details")
+		log.WithError(err).Warn("unable to encode _cluster/settings response")
+	}
+}
+
+// flattenSettings turns nested settings into dotted keys, and their values into strings the way
+// OpenSearch stores them. Null values are kept to reset settings.
+func flattenSettings(settings map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	var flatten func(prefix string, value interface{})
+	flatten = func(prefix string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				flatten(prefix+k+".", child)
+			}
+		case []interface{}:
+			values := make([]interface{}, 0, len(v))
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+			flat[strings.TrimSuffix(prefix, ".")] = values
+		case nil:
+			flat[strings.TrimSuffix(prefix, ".")] = nil
+		default:
+			flat[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(v)
+		}
+	}
+	flatten("", settings)
+
+	return flat
+}
+
+// applySettings sets the updated settings, and removes those set to null. Null keys may end with a
+// wildcard, such as cluster.routing.*, to reset a whole group.
+func applySettings(settings, update map[string]interface{}) map[string]interface{} {
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+
+	for key, value := range update {
+		if value != nil {
+			settings[key] = value
+			continue
+		}
+		for existing := range settings {
+			if ok, _ := path.Match(key, existing); ok || existing == key {
+				delete(settings, existing)
+			}
+		}
+	}
+
+	return settings
+}
+
+// formatSettings returns flat settings as is, or nested on the dots of their keys.
+func formatSettings(settings map[string]interface{}, flat bool) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range settings {
+		if value == nil {
+			continue
+		}
+		if flat {
+			result[key] = value
+			continue
+		}
+
+		parts := strings.Split(key, ".")
+		node := result
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+
+	return result
+}
+
+// BulkHandler serves _bulk requests item by item, other requests are served by Next. Requests larger
+// than MaxChunkSize bytes or MaxChunkItems items are split on item boundaries into several _bulk
+// requests, whose results are stitched back into a single response. Items failing with one of the
+// Retry status codes are resubmitted on their own.
+type BulkHandler struct {
+	Client Client
+	Next   http.Handler
+	// Retry decides how many times failed items are sent again and how long to wait in between.
+	// StatusCodes are matched against item statuses, Methods and APIs are ignored. Nil disables
+	// resubmitting failed items.
+	Retry *RetryPolicy
+	// MaxChunkSize and MaxChunkItems bound the _bulk requests sent upstream, zero for no limit.
+	MaxChunkSize  int64
+	MaxChunkItems int
+	// Concurrency is how many chunks are sent at once, they are sent one after the other when 1 or less.
+	Concurrency int
+
+	// MaxBodySize, MemoryBufferSize and TempDir bound the request body held while its items are sent,
+	// the same way as for ProxyClient.
+	MaxBodySize      int64
+	MemoryBufferSize int64
+	TempDir          string
+}
+
+func (h *BulkHandler) handles(r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return false
+	}
+
+	// A filtered response may not carry the item statuses
+	return requestAPIFamily(r) == "_bulk" && r.URL.Query().Get("filter_path") == ""
+}
+
+func (h *BulkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.handles(r) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := spoolBody(r.Body, h.MemoryBufferSize, h.MaxBodySize, h.TempDir)
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	items, err := parseBulk(body.NewReader())
+	if err != nil || len(items) == 0 {
+		// Let upstream report the malformed request in its own words
+		log.WithError(err).Debug("unable to parse bulk request, proxying it as is")
+		r.Body = io.NopCloser(body.NewReader())
+		r.ContentLength = body.Size()
+		h.Next.ServeHTTP(w, r)
+		return
 	}
+
+	inFlightRequests.Inc()
+	defer inFlightRequests.Dec()
+
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() {
+		responseSize.WithLabelValues(r.Method, requestAPIFamily(r)).Observe(float64(cw.written))
+	}()
+	w = cw
+
+	chunks := h.split(items)
+	if len(chunks) > 1 {
+		log.WithField("items", len(items)).WithField("chunks", len(chunks)).Debug("splitting bulk request")
+	}
+	sent := h.sendChunks(r, body, chunks)
+
+	// Forward the response of an unsplit request as is unless items were resubmitted
+	if len(sent) == 1 && !sent[0].merged {
+		if sent[0].err != nil {
+			writeProxyError(w, sent[0].err)
+			return
+		}
+		writeResponse(w, sent[0].resp, sent[0].raw)
+		return
+	}
+
+	result := stitchBulk(r, chunks, sent)
+	b, err := json.Marshal(result)
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// split groups items into chunks within MaxChunkSize and MaxChunkItems. An item larger than
+// MaxChunkSize is sent on its own, for upstream to reject.
+func (h *BulkHandler) split(items []bulkItem) [][]bulkItem {
+	var chunks [][]bulkItem
+	start, size := 0, int64(0)
+	for i, item := range items {
+		count := i - start
+		full := (h.MaxChunkItems > 0 && count >= h.MaxChunkItems) || (h.MaxChunkSize > 0 && size+item.size > h.MaxChunkSize)
+		if count > 0 && full {
+			chunks = append(chunks, items[start:i])
+			start, size = i, 0
+		}
+		size += item.size
+	}
+
+	return append(chunks, items[start:])
+}
+
+// sendChunks sends chunks with at most Concurrency of them in flight, keeping their order.
+func (h *BulkHandler) sendChunks(r *http.Request, body *spool, chunks [][]bulkItem) []*bulkChunk {
+	sent := make([]*bulkChunk, len(chunks))
+
+	concurrency := h.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i := range chunks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sent[i] = h.sendChunk(r, body, chunks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return sent
+}
+
+// stitchBulk merges the results of every chunk into one _bulk response. Items of chunks without
+// results are reported as failed with the status upstream answered, or 502 when there was none.
+// took adds up the time upstream spent on every chunk.
+func stitchBulk(r *http.Request, chunks [][]bulkItem, sent []*bulkChunk) *bulkResponse {
+	result := &bulkResponse{Items: []json.RawMessage{}}
+	for i, c := range sent {
+		if c.result != nil {
+			result.Took += c.result.Took
+			result.Items = append(result.Items, c.result.Items...)
+			continue
+		}
+
+		status, reason := http.StatusBadGateway, ""
+		if c.err != nil {
+			reason = c.err.Error()
+		} else {
+			status = c.resp.StatusCode
+			reason = fmt.Sprintf("upstream answered %d: %s", status, truncate(string(c.raw), 512))
+		}
+		log.WithField("items", len(chunks[i])).WithField("status_code", status).Warn("bulk chunk failed")
+		for _, item := range chunks[i] {
+			result.Items = append(result.Items, failedBulkItem(r, item, status, reason))
+		}
+	}
+
+	for _, item := range result.Items {
+		if bulkItemStatus(item).Error != nil {
+			result.Errors = true
+			break
+		}
+	}
+
+	return result
+}
+
+// failedBulkItem is the result of an item whose chunk failed as a whole.
+func failedBulkItem(r *http.Request, item bulkItem, status int, reason string) json.RawMessage {
+	var action map[string]struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}
+	json.Unmarshal(item.action, &action)
+
+	meta := action[item.op]
+	if meta.Index == "" {
+		// Items may rely on the index given in the path
+		if segment := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]; !strings.HasPrefix(segment, "_") {
+			meta.Index = segment
+		}
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		item.op: map[string]interface{}{
+			"_index": meta.Index,
+			"_id":    meta.ID,
+			"status": status,
+			"error": map[string]string{
+				"type":   "bulk_chunk_exception",
+				"reason": reason,
+			},
+		},
+	})
+
+	return b
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n] + "..."
 }
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoHandler_ServeHTTP(t *testing.T) {
+	legacy := DefaultInfo()
+	legacy.Version.Distribution = ""
+	legacy.Version.Number = "7.10.2"
+
+	h := &InfoHandler{
+		Info: DefaultInfo(),
+		Profiles: []InfoProfile{
+			{Name: "legacy", UserAgent: regexp.MustCompile(`^Logstash/`), Info: legacy},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		userAgent  string
+		wantNumber string
+	}{
+		{name: "should report the default identity", userAgent: "opensearch-py/2.2.0", wantNumber: "2.3.0"},
+		{name: "should report the identity of the matching profile", userAgent: "Logstash/7.16.3", wantNumber: "7.10.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			var info Info
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+			assert.Equal(t, tt.wantNumber, info.Version.Number)
+			assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestClusterState_ServeHTTP(t *testing.T) {
+	upstream := &jsonUpstream{responses: map[string]string{
+		"/_mapping":      `{"logs":{"mappings":{"properties":{"message":{"type":"text"}}}},"empty":{"mappings":{}}}`,
+		"/_alias":        `{"logs":{"aliases":{"recent":{},"all":{}}},"empty":{"aliases":{}}}`,
+		"/logs/_mapping": `{"logs":{"mappings":{}}}`,
+		"/logs/_alias":   `{"logs":{"aliases":{}}}`,
+	}}
+	h := &ClusterState{Client: upstream}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   string
+	}{
+		{
+			name:   "should assemble the metadata of every index",
+			target: "/_cluster/state/metadata",
+			status: http.StatusOK,
+			want: `{"cluster_name":"serverless","cluster_uuid":"0","metadata":{"cluster_uuid":"0","templates":{},"indices":{` +
+				`"empty":{"state":"open","settings":{"index":{"number_of_replicas":"0","number_of_shards":"1","provided_name":"empty","uuid":"_na_"}},"mappings":{},"aliases":[]},` +
+				`"logs":{"state":"open","settings":{"index":{"number_of_replicas":"0","number_of_shards":"1","provided_name":"logs","uuid":"_na_"}},"mappings":{"_doc":{"properties":{"message":{"type":"text"}}}},"aliases":["all","recent"]}}}}`,
+		},
+		{
+			name:   "should only describe the requested indices",
+			target: "/_cluster/state/metadata/logs",
+			status: http.StatusOK,
+			want: `{"cluster_name":"serverless","cluster_uuid":"0","metadata":{"cluster_uuid":"0","templates":{},"indices":{` +
+				`"logs":{"state":"open","settings":{"index":{"number_of_replicas":"0","number_of_shards":"1","provided_name":"logs","uuid":"_na_"}},"mappings":{},"aliases":[]}}}}`,
+		},
+		{
+			name:   "should leave out the metrics not requested",
+			target: "/_cluster/state/version,master_node",
+			status: http.StatusOK,
+			want:   `{"cluster_name":"serverless","cluster_uuid":"0","version":1,"state_uuid":"0","master_node":"abcdefgh","cluster_manager_node":"abcdefgh"}`,
+		},
+		{
+			name:   "should relay upstream errors",
+			target: "/_cluster/state/metadata/missing",
+			status: http.StatusNotFound,
+			want:   `{"error":{"type":"index_not_found_exception"},"status":404}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.JSONEq(t, tt.want, rec.Body.String())
+		})
+	}
+}
+
+func TestClusterSettings_ServeHTTP(t *testing.T) {
+	h := &ClusterSettings{}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   string
+	}{
+		{
+			name:   "should start without settings",
+			method: "GET",
+			target: "/_cluster/settings",
+			want:   `{"persistent":{},"transient":{}}`,
+		},
+		{
+			name:   "should echo updated settings back",
+			method: "PUT",
+			target: "/_cluster/settings",
+			body:   `{"persistent":{"action.auto_create_index":false,"cluster":{"routing":{"allocation":{"enable":"all"}}}}}`,
+			want:   `{"acknowledged":true,"persistent":{"action":{"auto_create_index":"false"},"cluster":{"routing":{"allocation":{"enable":"all"}}}},"transient":{}}`,
+		},
+		{
+			name:   "should keep settings",
+			method: "GET",
+			target: "/_cluster/settings?flat_settings=true",
+			want:   `{"persistent":{"action.auto_create_index":"false","cluster.routing.allocation.enable":"all"},"transient":{}}`,
+		},
+		{
+			name:   "should reset settings set to null",
+			method: "PUT",
+			target: "/_cluster/settings",
+			body:   `{"persistent":{"cluster.routing.*":null},"transient":{"search.max_buckets":20000}}`,
+			want:   `{"acknowledged":true,"persistent":{},"transient":{"search":{"max_buckets":"20000"}}}`,
+		},
+		{
+			name:   "should not keep reset settings",
+			method: "GET",
+			target: "/_cluster/settings?flat_settings=true",
+			want:   `{"persistent":{"action.auto_create_index":"false"},"transient":{"search.max_buckets":"20000"}}`,
+		},
+	}
+
+	// Cases run in order, each one sees the settings left by the previous ones
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, tt.want, rec.Body.String())
+		})
+	}
+}
+
+// countUpstream answers _count requests with counts, one after the other, then with the last one.
+type countUpstream struct {
+	counts   []int64
+	requests int
+}
+
+func (u *countUpstream) Do(req *http.Request) (*http.Response, error) {
+	count := u.counts[len(u.counts)-1]
+	if u.requests < len(u.counts) {
+		count = u.counts[u.requests]
+	}
+	u.requests++
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"count":%d}`, count))),
+	}, nil
+}
+
+func TestNoopHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		counts       []int64
+		status       int
+		want         string
+		wantRequests int
+	}{
+		{
+			name:   "should fake success",
+			policy: NoopFake,
+			counts: []int64{1},
+			status: http.StatusOK,
+			want:   `{"_shards":{"total":1,"successful":1,"failed":0}}`,
+		},
+		{
+			name:   "should answer with an error",
+			policy: NoopError,
+			counts: []int64{1},
+			status: http.StatusBadRequest,
+			want: `{"error":{"root_cause":[{"type":"illegal_argument_exception","reason":"_refresh is not supported by OpenSearch Serverless"}],` +
+				`"type":"illegal_argument_exception","reason":"_refresh is not supported by OpenSearch Serverless"},"status":400}`,
+		},
+		{
+			name:         "should wait for the document count to stop changing",
+			policy:       NoopEmulate,
+			counts:       []int64{1, 5, 9, 9},
+			status:       http.StatusOK,
+			want:         `{"_shards":{"total":1,"successful":1,"failed":0}}`,
+			wantRequests: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &countUpstream{counts: tt.counts}
+			emulator := &RefreshEmulator{Client: upstream, Interval: time.Millisecond, Timeout: time.Second}
+			h := &NoopHandler{API: "_refresh", Policy: tt.policy, Fake: http.HandlerFunc(RefreshAll), Emulate: emulator.Wait}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/logs/_refresh", nil))
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.JSONEq(t, tt.want, rec.Body.String())
+			assert.Equal(t, tt.wantRequests, upstream.requests)
+		})
+	}
+}
+
+func TestRefreshEmulator_WaitTimesOut(t *testing.T) {
+	upstream := &countUpstream{counts: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}}
+	emulator := &RefreshEmulator{Client: upstream, Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := emulator.Wait(httptest.NewRequest("POST", "/_refresh", nil))
+
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Less(t, upstream.requests, 20)
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	Name string
+	// Method is how the client authenticated, api_key, basic or jwt.
+	Method string
+	// Groups are the groups the client belongs to, as claimed by its token.
+	Groups []string
+}
+
+// matches tells whether the principal is one of names, which are principal names, group:<name> for
+// the members of a group, or * for anyone.
+func (p *Principal) matches(names []string) bool {
+	for _, name := range names {
+		if name == "*" {
+			return true
+		}
+		if p == nil {
+			continue
+		}
+		if name == p.Name {
+			return true
+		}
+		if group := strings.TrimPrefix(name, "group:"); group != name {
+			for _, g := range p.Groups {
+				if g == group {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the authenticated client.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the authenticated client of a request, nil when authentication is disabled.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// errNoCredentials is returned by authenticators when a request carries no credentials of their kind.
+var errNoCredentials = errors.New("no credentials")
+
+// Authenticator authenticates the client of a request from its Authorization header. It returns
+// errNoCredentials when the request carries none of its kind, for the next authenticator to try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+	// Challenge is the WWW-Authenticate challenge of the scheme.
+	Challenge() string
+}
+
+// Authentication rejects requests none of the Authenticators accepts with an OpenSearch style 401, and
+// serves the others with Next, their principal in the request context. The Authorization header is
+// removed before the request is signed.
+type Authentication struct {
+	Authenticators []Authenticator
+	Next           http.Handler
+}
+
+func (a *Authentication) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, authenticator := range a.Authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("remote_addr", r.RemoteAddr).Warn("rejected invalid credentials")
+			a.unauthorized(w, fmt.Sprintf("unable to authenticate user for REST request [%s]", r.URL.Path))
+			return
+		}
+
+		r = r.Clone(WithPrincipal(r.Context(), principal))
+		r.Header.Del("Authorization")
+		a.Next.ServeHTTP(w, r)
+		return
+	}
+
+	a.unauthorized(w, fmt.Sprintf("missing authentication credentials for REST request [%s]", r.URL.Path))
+}
+
+func (a *Authentication) unauthorized(w http.ResponseWriter, reason string) {
+	for _, authenticator := range a.Authenticators {
+		w.Header().Add("WWW-Authenticate", authenticator.Challenge())
+	}
+	writeOpenSearchError(w, http.StatusUnauthorized, "security_exception", reason)
+}
+
+// authorization returns the credentials of the Authorization header of r for scheme, case insensitively.
+func authorization(r *http.Request, scheme string) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) || header[len(scheme)] != ' ' {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len(scheme)+1:]), true
+}
+
+// APIKeys authenticates clients sending Authorization: ApiKey with one of the keys, by name. The
+// credentials are either the key, or the base64 encoding of name:key like Elasticsearch API keys.
+type APIKeys struct {
+	// keys are the SHA-256 hashes of the keys, by name.
+	keys map[string][32]byte
+}
+
+// LoadAPIKeys reads a file of name:key lines, blank lines and lines starting with # are ignored.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	entries, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &APIKeys{keys: map[string][32]byte{}}
+	for name, key := range entries {
+		keys.keys[name] = sha256.Sum256([]byte(key))
+	}
+
+	return keys, nil
+}
+
+func (k *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := authorization(r, "ApiKey")
+	if !ok {
+		return nil, errNoCredentials
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(token); err == nil {
+		if name, key, ok := strings.Cut(string(decoded), ":"); ok {
+			if hash, ok := k.keys[name]; ok && k.equal(hash, key) {
+				return &Principal{Name: name, Method: "api_key"}, nil
+			}
+		}
+	}
+
+	// Compare against every key for the time taken not to tell which exist
+	name := ""
+	for n, hash := range k.keys {
+		if k.equal(hash, token) {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("unknown API key")
+	}
+
+	return &Principal{Name: name, Method: "api_key"}, nil
+}
+
+func (k *APIKeys) equal(hash [32]byte, key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(hash[:], sum[:]) == 1
+}
+
+func (k *APIKeys) Challenge() string {
+	return "ApiKey"
+}
+
+// unknownUserHash is compared with the passwords of unknown users, it is a bcrypt hash of the default cost.
+var unknownUserHash = []byte("$2a$10$hrydpe95LazEc5LVC8m/6ulqWbY8whHZTK9V2khNOkkyAmeW9wMDK")
+
+// Htpasswd authenticates clients sending HTTP Basic credentials against the bcrypt hashes of an
+// htpasswd file.
+type Htpasswd struct {
+	Realm  string
+	hashes map[string][]byte
+}
+
+// LoadHtpasswd reads an htpasswd file, whose passwords must be hashed with bcrypt, as htpasswd -B does.
+func LoadHtpasswd(path, realm string) (*Htpasswd, error) {
+	entries, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Htpasswd{Realm: realm, hashes: map[string][]byte{}}
+	for user, hash := range entries {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: user %s: only bcrypt hashes are supported: %w", path, user, err)
+		}
+		h.hashes[user] = []byte(hash)
+	}
+
+	return h, nil
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (*Principal, error) {
+	if _, ok := authorization(r, "Basic"); !ok {
+		return nil, errNoCredentials
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("malformed basic credentials")
+	}
+
+	hash, ok := h.hashes[user]
+	if !ok {
+		// Spend as long as for known users, so that response times do not tell which users exist
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		return nil, fmt.Errorf("unknown user %s", user)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, fmt.Errorf("user %s: %w", user, err)
+	}
+
+	return &Principal{Name: user, Method: "basic"}, nil
+}
+
+func (h *Htpasswd) Challenge() string {
+	return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, h.Realm)
+}
+
+// readColonFile reads the name:value lines of a file, ignoring blank lines and comments.
+func readColonFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:value", path, n)
+		}
+		if _, ok := entries[name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate name %s", path, n, name)
+		}
+		entries[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestAuthentication_ServeHTTP(t *testing.T) {
+	keys, err := LoadAPIKeys(writeTempFile(t, "keys", "# CI pipelines\nci:s3cr3t\n\nbackup:0ther\n"))
+	assert.NoError(t, err)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	htpasswd, err := LoadHtpasswd(writeTempFile(t, "htpasswd", "alice:"+string(hash)+"\n"), "proxy")
+	assert.NoError(t, err)
+
+	var principal *Principal
+	var authorization string
+	h := &Authentication{
+		Authenticators: []Authenticator{keys, htpasswd},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal = PrincipalFrom(r.Context())
+			authorization = r.Header.Get("Authorization")
+		}),
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		want          *Principal
+		wantReason    string
+	}{
+		{
+			name:          "should accept API keys",
+			authorization: "ApiKey s3cr3t",
+			status:        http.StatusOK,
+			want:          &Principal{Name: "ci", Method: "api_key"},
+		},
+		{
+			name:          "should accept Elasticsearch style API keys",
+			authorization: "ApiKey " + base64.StdEncoding.EncodeToString([]byte("backup:0ther")),
+			status:        http.StatusOK,
+			want:          &Principal{Name: "backup", Method: "api_key"},
+		},
+		{
+			name:          "should accept basic credentials",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:hunter2")),
+			status:        http.StatusOK,
+			want:          &Principal{Name: "alice", Method: "basic"},
+		},
+		{
+			name:          "should reject wrong passwords",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:hunter3")),
+			status:        http.StatusUnauthorized,
+			wantReason:    "unable to authenticate user for REST request [/logs/_search]",
+		},
+		{
+			name:          "should reject unknown API keys",
+			authorization: "ApiKey nope",
+			status:        http.StatusUnauthorized,
+			wantReason:    "unable to authenticate user for REST request [/logs/_search]",
+		},
+		{
+			name:       "should reject requests without credentials",
+			status:     http.StatusUnauthorized,
+			wantReason: "missing authentication credentials for REST request [/logs/_search]",
+		},
+		{
+			name:          "should reject unsupported schemes",
+			authorization: "Bearer abc",
+			status:        http.StatusUnauthorized,
+			wantReason:    "missing authentication credentials for REST request [/logs/_search]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, authorization = nil, ""
+			req := httptest.NewRequest("GET", "/logs/_search", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.want, principal)
+			assert.Empty(t, authorization)
+			if tt.status == http.StatusUnauthorized {
+				assert.Equal(t, []string{"ApiKey", `Basic realm="proxy", charset="UTF-8"`}, rec.Header().Values("WWW-Authenticate"))
+				assert.JSONEq(t, `{"error":{"root_cause":[{"type":"security_exception","reason":"`+tt.wantReason+`"}],`+
+					`"type":"security_exception","reason":"`+tt.wantReason+`"},"status":401}`, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHtpasswd_AuthenticateUnknownUser(t *testing.T) {
+	h := &Htpasswd{hashes: map[string][]byte{}}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("mallory", "guess")
+
+	_, err := h.Authenticate(req)
+	assert.EqualError(t, err, "unknown user mallory")
+
+	// Unknown users are checked against a hash as costly as those of htpasswd -B
+	cost, err := bcrypt.Cost(unknownUserHash)
+	assert.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	_, err := LoadHtpasswd(writeTempFile(t, "htpasswd", "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), "proxy")
+	assert.ErrorContains(t, err, "user bob: only bcrypt hashes are supported")
+
+	_, err = LoadHtpasswd(writeTempFile(t, "htpasswd", "bob\n"), "proxy")
+	assert.ErrorContains(t, err, ":1: expected name:value")
+}
@@ -0,0 +1,418 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations authorized by IndexPolicy.
+const (
+	OperationRead   = "read"
+	OperationWrite  = "write"
+	OperationDelete = "delete"
+	OperationAdmin  = "admin"
+)
+
+// IndexPolicy allows the principals it names the operations on the indices matching its patterns.
+type IndexPolicy struct {
+	Name string
+	// Principals are principal names, group:<name> for the members of a group, or * for anyone.
+	Principals []string
+	// Indices are index names, where * matches any characters.
+	Indices []string
+	// Operations are read, write, delete, admin, or * for all of them.
+	Operations []string
+}
+
+func (p *IndexPolicy) appliesTo(principal *Principal) bool {
+	return principal.matches(p.Principals)
+}
+
+func (p *IndexPolicy) allows(access indexAccess) bool {
+	if !containsFold(p.Operations, access.operation) && !containsFold(p.Operations, "*") {
+		return false
+	}
+
+	// A requested pattern is allowed when a policy pattern matches it with its wildcards taken
+	// literally, logs-* allows logs-2023-* but not *
+	for _, pattern := range p.Indices {
+		if ok, _ := path.Match(pattern, access.index); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// indexAccess is an operation a request makes on an index, or index pattern.
+type indexAccess struct {
+	index     string
+	operation string
+}
+
+// Authorization only lets principals make the operations their Policies allow on the indices
+// targeted by their requests, which are read from the path and from the bodies of _bulk, _msearch
+// and _mget requests. Read requests to cluster APIs are allowed to every principal, other requests
+// to cluster APIs require admin on every index. It wraps the handler of a route, for paths to be checked
+// once the route has stripped its prefix.
+type Authorization struct {
+	Policies []IndexPolicy
+	Next     http.Handler
+
+	// MaxBodySize, MemoryBufferSize and TempDir bound the request bodies read, the same way as
+	// for ProxyClient.
+	MaxBodySize      int64
+	MemoryBufferSize int64
+	TempDir          string
+}
+
+func (a *Authorization) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal := PrincipalFrom(r.Context())
+
+	var body *spool
+	if hasIndicesInBody(r) {
+		var err error
+		body, err = spoolBody(r.Body, a.MemoryBufferSize, a.MaxBodySize, a.TempDir)
+		if err != nil {
+			writeProxyError(w, err)
+			return
+		}
+		defer body.Close()
+		r.Body = io.NopCloser(body.NewReader())
+		r.ContentLength = body.Size()
+	}
+
+	accesses, err := requestAccesses(r, body)
+	if err != nil {
+		a.forbidden(w, r, principal, fmt.Sprintf("unable to tell the indices of the request: %v", err))
+		return
+	}
+	if body != nil {
+		r.Body = io.NopCloser(body.NewReader())
+	}
+
+	for _, access := range accesses {
+		if !a.allowed(principal, access) {
+			a.forbidden(w, r, principal, fmt.Sprintf("no permissions for [%s] on index [%s] and User [name=%s]", access.operation, access.index, principalName(principal)))
+			return
+		}
+	}
+
+	a.Next.ServeHTTP(w, r)
+}
+
+func (a *Authorization) allowed(principal *Principal, access indexAccess) bool {
+	for i := range a.Policies {
+		policy := &a.Policies[i]
+		if policy.appliesTo(principal) && policy.allows(access) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Authorization) forbidden(w http.ResponseWriter, r *http.Request, principal *Principal, reason string) {
+	log.WithFields(log.Fields{"principal": principalName(principal), "method": r.Method, "path": r.URL.Path}).Info(reason)
+	writeOpenSearchError(w, http.StatusForbidden, "security_exception", reason)
+}
+
+func principalName(principal *Principal) string {
+	if principal == nil {
+		return ""
+	}
+
+	return principal.Name
+}
+
+// indexAPIs are the APIs on indices, which target every index when the path names none.
+var indexAPIs = map[string]bool{
+	"_alias":           true,
+	"_aliases":         true,
+	"_bulk":            true,
+	"_count":           true,
+	"_delete_by_query": true,
+	"_field_caps":      true,
+	"_forcemerge":      true,
+	"_mapping":         true,
+	"_mappings":        true,
+	"_mget":            true,
+	"_msearch":         true,
+	"_refresh":         true,
+	"_search":          true,
+	"_settings":        true,
+	"_stats":           true,
+	"_update_by_query": true,
+}
+
+// hasIndicesInBody tells whether the body of r names indices, whatever the method.
+func hasIndicesInBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+
+	switch requestAPI(r.URL.Path) {
+	case "_bulk", "_msearch", "_mget":
+		return true
+	}
+
+	return false
+}
+
+// requestAPI returns the first underscore prefixed segment of a path, empty when there is none.
+func requestAPI(p string) string {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, "_") {
+			return segment
+		}
+	}
+
+	return ""
+}
+
+// requestAccesses returns the operations r makes on indices.
+func requestAccesses(r *http.Request, body *spool) ([]indexAccess, error) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	api := requestAPI(r.URL.Path)
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// Indices named by the path
+	var indices []string
+	switch {
+	case segments[0] != "" && !strings.HasPrefix(segments[0], "_"):
+		indices = splitIndices(segments[0])
+	case api == "_cat" && len(segments) == 3 && (segments[1] == "indices" || segments[1] == "count" || segments[1] == "aliases"):
+		indices = splitIndices(segments[2])
+	case api == "_cat" && len(segments) == 2 && (segments[1] == "indices" || segments[1] == "count" || segments[1] == "aliases"):
+		indices = []string{"*"}
+	case api == "_cluster" && len(segments) == 3 && segments[1] == "health":
+		indices = splitIndices(segments[2])
+	case api == "_cluster" && len(segments) == 4 && segments[1] == "state":
+		indices = splitIndices(segments[3])
+	case api == "_cluster" && len(segments) >= 2 && segments[1] == "state" && read:
+		indices = []string{"*"}
+	case api == "_search" && len(segments) > 1 && (segments[1] == "scroll" || segments[1] == "point_in_time"):
+		// Scrolls and point in time searches carry their indices in their ids
+		return nil, nil
+	case indexAPIs[api]:
+		indices = []string{"*"}
+	default:
+		// Cluster APIs, such as GET / or _nodes
+		if read {
+			return nil, nil
+		}
+		return []indexAccess{{index: "*", operation: OperationAdmin}}, nil
+	}
+
+	var accesses []indexAccess
+	add := func(operation string, names ...string) {
+		for _, name := range names {
+			accesses = append(accesses, indexAccess{index: name, operation: operation})
+		}
+	}
+
+	switch api {
+	case "_bulk", "_msearch", "_mget":
+		// Without a body to read the indices from, the request could target any index
+		if body == nil {
+			return []indexAccess{{index: "*", operation: OperationAdmin}}, nil
+		}
+	}
+
+	switch api {
+	case "_bulk":
+		return bulkAccesses(body.NewReader(), indices)
+	case "_msearch":
+		return msearchAccesses(body.NewReader(), indices)
+	case "_mget":
+		return mgetAccesses(body.NewReader(), indices)
+	case "_doc", "_create", "_update", "_source":
+		switch {
+		case read:
+			add(OperationRead, indices...)
+		case r.Method == http.MethodDelete:
+			add(OperationDelete, indices...)
+		default:
+			add(OperationWrite, indices...)
+		}
+	case "_update_by_query", "_refresh":
+		add(OperationWrite, indices...)
+	case "_delete_by_query":
+		add(OperationDelete, indices...)
+	case "_search", "_count", "_field_caps", "_stats", "_cat", "_cluster", "_validate", "_explain", "_termvectors", "_mtermvectors", "_rank_eval":
+		add(OperationRead, indices...)
+	default:
+		// The index itself and its mappings, settings and aliases
+		if read {
+			add(OperationRead, indices...)
+		} else {
+			add(OperationAdmin, indices...)
+		}
+	}
+
+	return accesses, nil
+}
+
+// splitIndices returns the indices of a comma separated list, _all standing for every index. Excluded
+// indices, such as -logs, only narrow the request and are left out.
+func splitIndices(list string) []string {
+	var indices []string
+	for _, index := range strings.Split(list, ",") {
+		switch {
+		case index == "" || strings.HasPrefix(index, "-"):
+		case index == "_all":
+			indices = append(indices, "*")
+		default:
+			indices = append(indices, index)
+		}
+	}
+	if len(indices) == 0 {
+		return []string{"*"}
+	}
+
+	return indices
+}
+
+// bodyIndices returns the indices named by a body, or those of the path when it names none.
+func bodyIndices(index interface{}, pathIndices []string) ([]string, error) {
+	switch v := index.(type) {
+	case nil:
+		if len(pathIndices) == 0 {
+			return []string{"*"}, nil
+		}
+		return pathIndices, nil
+	case string:
+		return splitIndices(v), nil
+	case []interface{}:
+		var indices []string
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid index %v", item)
+			}
+			indices = append(indices, splitIndices(s)...)
+		}
+		return indices, nil
+	}
+
+	return nil, fmt.Errorf("invalid index %v", index)
+}
+
+func bulkAccesses(r io.Reader, pathIndices []string) ([]indexAccess, error) {
+	items, err := parseBulk(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var accesses []indexAccess
+	for _, item := range items {
+		var action map[string]struct {
+			Index interface{} `json:"_index"`
+		}
+		if err := json.Unmarshal(item.action, &action); err != nil {
+			return nil, err
+		}
+		indices, err := bodyIndices(action[item.op].Index, pathIndices)
+		if err != nil {
+			return nil, err
+		}
+
+		operation := OperationWrite
+		if item.op == "delete" {
+			operation = OperationDelete
+		}
+		for _, index := range indices {
+			accesses = append(accesses, indexAccess{index: index, operation: operation})
+		}
+	}
+
+	return accesses, nil
+}
+
+func msearchAccesses(r io.Reader, pathIndices []string) ([]indexAccess, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	var accesses []indexAccess
+	header := true
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if header {
+				var h struct {
+					Index interface{} `json:"index"`
+				}
+				if err := json.Unmarshal(trimmed, &h); err != nil {
+					return nil, err
+				}
+				indices, err := bodyIndices(h.Index, pathIndices)
+				if err != nil {
+					return nil, err
+				}
+				for _, index := range indices {
+					accesses = append(accesses, indexAccess{index: index, operation: OperationRead})
+				}
+			}
+			header = !header
+		}
+		if err == io.EOF {
+			return accesses, nil
+		}
+	}
+}
+
+func mgetAccesses(r io.Reader, pathIndices []string) ([]indexAccess, error) {
+	var mget struct {
+		Docs []struct {
+			Index interface{} `json:"_index"`
+		} `json:"docs"`
+		IDs []interface{} `json:"ids"`
+	}
+	if err := json.NewDecoder(r).Decode(&mget); err != nil {
+		return nil, err
+	}
+
+	var accesses []indexAccess
+	for _, doc := range mget.Docs {
+		indices, err := bodyIndices(doc.Index, pathIndices)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indices {
+			accesses = append(accesses, indexAccess{index: index, operation: OperationRead})
+		}
+	}
+	if len(mget.IDs) > 0 {
+		indices, _ := bodyIndices(nil, pathIndices)
+		for _, index := range indices {
+			accesses = append(accesses, indexAccess{index: index, operation: OperationRead})
+		}
+	}
+
+	return accesses, nil
+}
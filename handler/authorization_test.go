@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorization_ServeHTTP(t *testing.T) {
+	var body string
+	h := &Authorization{
+		Policies: []IndexPolicy{
+			{Name: "ingest", Principals: []string{"fluent-bit"}, Indices: []string{"logs-*"}, Operations: []string{"write"}},
+			{Name: "analysts", Principals: []string{"group:analysts"}, Indices: []string{"logs-*", "metrics"}, Operations: []string{"read"}},
+			{Name: "admins", Principals: []string{"root"}, Indices: []string{"*"}, Operations: []string{"*"}},
+		},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+		}),
+		MemoryBufferSize: 1 << 20,
+	}
+
+	ingest := &Principal{Name: "fluent-bit"}
+	analyst := &Principal{Name: "alice", Groups: []string{"analysts"}}
+	root := &Principal{Name: "root"}
+
+	tests := []struct {
+		name       string
+		principal  *Principal
+		method     string
+		path       string
+		body       string
+		wantReason string
+	}{
+		{name: "should allow reads of matching indices", principal: analyst, method: "GET", path: "/logs-2023/_search"},
+		{
+			name: "should check search templates on every index", principal: analyst, method: "POST", path: "/_search/template", body: "{}",
+			wantReason: "no permissions for [read] on index [*] and User [name=alice]",
+		},
+		{name: "should check search templates on their indices", principal: analyst, method: "POST", path: "/logs-2023/_search/template", body: "{}"},
+		{name: "should allow scrolls", principal: analyst, method: "POST", path: "/_search/scroll", body: "{}"},
+		{name: "should allow reads of narrower patterns", principal: analyst, method: "POST", path: "/logs-2023-*,metrics/_count"},
+		{
+			name: "should reject reads of wider patterns", principal: analyst, method: "GET", path: "/_search",
+			wantReason: "no permissions for [read] on index [*] and User [name=alice]",
+		},
+		{
+			name: "should reject writes with read permissions", principal: analyst, method: "PUT", path: "/logs-2023/_doc/1", body: "{}",
+			wantReason: "no permissions for [write] on index [logs-2023] and User [name=alice]",
+		},
+		{name: "should allow writes with write permissions", principal: ingest, method: "PUT", path: "/logs-2023/_doc/1", body: "{}"},
+		{
+			name: "should tell deletes from writes", principal: ingest, method: "DELETE", path: "/logs-2023/_doc/1",
+			wantReason: "no permissions for [delete] on index [logs-2023] and User [name=fluent-bit]",
+		},
+		{
+			name: "should require admin to create indices", principal: ingest, method: "PUT", path: "/logs-2023",
+			wantReason: "no permissions for [admin] on index [logs-2023] and User [name=fluent-bit]",
+		},
+		{name: "should allow cluster reads", principal: ingest, method: "GET", path: "/_cluster/health"},
+		{
+			name: "should require admin for cluster writes", principal: analyst, method: "PUT", path: "/_cluster/settings", body: "{}",
+			wantReason: "no permissions for [admin] on index [*] and User [name=alice]",
+		},
+		{name: "should allow anything to admins", principal: root, method: "DELETE", path: "/metrics"},
+		{
+			name: "should read the indices of _cat targets", principal: analyst, method: "GET", path: "/_cat/indices/secrets",
+			wantReason: "no permissions for [read] on index [secrets] and User [name=alice]",
+		},
+		{
+			name: "should allow bulk items on allowed indices", principal: ingest, method: "POST", path: "/logs-2023/_bulk",
+			body: `{"index":{}}` + "\n" + `{"a":1}` + "\n" + `{"create":{"_index":"logs-2024"}}` + "\n" + `{"a":2}` + "\n",
+		},
+		{
+			name: "should reject bulk items on other indices", principal: ingest, method: "POST", path: "/_bulk",
+			body:       `{"index":{"_index":"logs-2023"}}` + "\n" + `{"a":1}` + "\n" + `{"delete":{"_index":"logs-2023","_id":"1"}}` + "\n",
+			wantReason: "no permissions for [delete] on index [logs-2023] and User [name=fluent-bit]",
+		},
+		{
+			name: "should read msearch headers", principal: analyst, method: "POST", path: "/logs-2023/_msearch",
+			body:       `{}` + "\n" + `{"query":{}}` + "\n" + `{"index":["metrics","secrets"]}` + "\n" + `{"query":{}}` + "\n",
+			wantReason: "no permissions for [read] on index [secrets] and User [name=alice]",
+		},
+		{
+			name: "should read mget docs", principal: analyst, method: "POST", path: "/_mget",
+			body: `{"docs":[{"_index":"logs-2023","_id":"1"},{"_index":"metrics","_id":"2"}]}`,
+		},
+		{
+			name: "should reject unparsable bodies", principal: ingest, method: "POST", path: "/_bulk", body: "nope\n",
+			wantReason: "unable to tell the indices of the request: invalid bulk action line: invalid character 'o' in literal null (expecting 'u')",
+		},
+		{
+			name: "should read bulk bodies whatever the method", principal: analyst, method: "DELETE", path: "/_bulk",
+			body:       `{"delete":{"_index":"logs-2023","_id":"1"}}` + "\n",
+			wantReason: "no permissions for [delete] on index [logs-2023] and User [name=alice]",
+		},
+		{
+			name: "should read msearch bodies whatever the method", principal: ingest, method: "DELETE", path: "/_msearch",
+			body:       `{"index":"logs-2023"}` + "\n" + `{"query":{}}` + "\n",
+			wantReason: "no permissions for [read] on index [logs-2023] and User [name=fluent-bit]",
+		},
+		{
+			name: "should read mget bodies whatever the method", principal: ingest, method: "DELETE", path: "/_mget",
+			body:       `{"docs":[{"_index":"logs-2023","_id":"1"}]}`,
+			wantReason: "no permissions for [read] on index [logs-2023] and User [name=fluent-bit]",
+		},
+		{
+			name: "should require admin for bulk without a body", principal: ingest, method: "POST", path: "/logs-2023/_bulk",
+			wantReason: "no permissions for [admin] on index [*] and User [name=fluent-bit]",
+		},
+		{
+			name: "should require admin for msearch without a body", principal: analyst, method: "GET", path: "/logs-2023/_msearch",
+			wantReason: "no permissions for [admin] on index [*] and User [name=alice]",
+		},
+		{
+			name: "should require admin for mget without a body", principal: analyst, method: "GET", path: "/logs-2023/_mget",
+			wantReason: "no permissions for [admin] on index [*] and User [name=alice]",
+		},
+		{
+			name: "should reject anonymous requests", method: "GET", path: "/logs-2023/_search",
+			wantReason: "no permissions for [read] on index [logs-2023] and User [name=]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body = ""
+			var reqBody io.Reader
+			if tt.body != "" {
+				reqBody = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, reqBody)
+			if tt.principal != nil {
+				req = req.WithContext(WithPrincipal(req.Context(), tt.principal))
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if tt.wantReason == "" {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, tt.body, body)
+			} else {
+				assert.Equal(t, http.StatusForbidden, rec.Code)
+				assert.JSONEq(t, `{"error":{"root_cause":[{"type":"security_exception","reason":"`+tt.wantReason+`"}],`+
+					`"type":"security_exception","reason":"`+tt.wantReason+`"},"status":403}`, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorization_StrippedPrefix(t *testing.T) {
+	var path string
+	router := NewRouter([]Route{{
+		Name:        "logs",
+		PathPrefix:  "/logs",
+		StripPrefix: true,
+		Handler: &Authorization{
+			Policies: []IndexPolicy{{Principals: []string{"alice"}, Indices: []string{"logs"}, Operations: []string{"read"}}},
+			Next:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { path = r.URL.Path }),
+		},
+	}})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantReason string
+	}{
+		{name: "should check the index after the prefix", method: "GET", path: "/logs/logs/_search"},
+		{
+			name: "should not take the prefix for an index", method: "GET", path: "/logs/secret/_search",
+			wantReason: "no permissions for [read] on index [secret] and User [name=alice]",
+		},
+		{
+			name: "should check cluster APIs after the prefix", method: "PUT", path: "/logs/_cluster/settings",
+			wantReason: "no permissions for [admin] on index [*] and User [name=alice]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path = ""
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req = req.WithContext(WithPrincipal(req.Context(), &Principal{Name: "alice"}))
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			if tt.wantReason == "" {
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, strings.TrimPrefix(tt.path, "/logs"), path)
+			} else {
+				assert.Equal(t, http.StatusForbidden, rec.Code)
+				assert.Contains(t, rec.Body.String(), tt.wantReason)
+			}
+		})
+	}
+}
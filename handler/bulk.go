@@ -0,0 +1,289 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkItem is one operation of a _bulk request: its action line followed, for every action but
+// delete, by its source line. Only the action line is held, the item is read back from the body.
+type bulkItem struct {
+	op     string
+	action []byte
+	offset int64
+	size   int64
+	// terminated is false for a last line lacking its newline
+	terminated bool
+}
+
+// parseBulk splits a _bulk NDJSON body into its operations.
+func parseBulk(r io.Reader) ([]bulkItem, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	var items []bulkItem
+	var offset int64
+	for {
+		action, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(action)) == 0 {
+			offset += int64(len(action))
+			if err == io.EOF {
+				return items, nil
+			}
+			continue
+		}
+
+		op, opErr := bulkOperation(action)
+		if opErr != nil {
+			return nil, opErr
+		}
+		item := bulkItem{op: op, action: bytes.TrimSpace(action), offset: offset, size: int64(len(action))}
+
+		if op != "delete" {
+			var source []byte
+			if err == nil {
+				source, err = br.ReadBytes('\n')
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+			}
+			if len(bytes.TrimSpace(source)) == 0 {
+				return nil, fmt.Errorf("bulk %s action at item %d has no source line", op, len(items))
+			}
+			item.size += int64(len(source))
+		}
+
+		item.terminated = err == nil
+		offset += item.size
+		items = append(items, item)
+		if err == io.EOF {
+			return items, nil
+		}
+	}
+}
+
+// bulkOperation returns the operation of a _bulk action line, such as index or delete.
+func bulkOperation(action []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(action, &fields); err != nil {
+		return "", fmt.Errorf("invalid bulk action line: %w", err)
+	}
+	if len(fields) != 1 {
+		return "", fmt.Errorf("bulk action line must have a single operation, got %d", len(fields))
+	}
+
+	for op := range fields {
+		switch op {
+		case "index", "create", "update", "delete":
+			return op, nil
+		default:
+			return "", fmt.Errorf("unknown bulk operation %s", op)
+		}
+	}
+
+	return "", nil
+}
+
+// bulkBody returns a _bulk body made of the given items of body, and its size.
+func bulkBody(body *spool, items []bulkItem) (io.Reader, int64) {
+	var readers []io.Reader
+	var size int64
+	for i := 0; i < len(items); {
+		// Read runs of adjacent items as a single section
+		j, end := i+1, items[i].offset+items[i].size
+		for j < len(items) && items[j].offset == end {
+			end += items[j].size
+			j++
+		}
+
+		readers = append(readers, body.Section(items[i].offset, end-items[i].offset))
+		size += end - items[i].offset
+		if !items[j-1].terminated {
+			readers = append(readers, strings.NewReader("\n"))
+			size++
+		}
+		i = j
+	}
+
+	return io.MultiReader(readers...), size
+}
+
+// bulkResponse is the body of a _bulk response, with items kept verbatim to be merged.
+type bulkResponse struct {
+	Took   int64             `json:"took"`
+	Errors bool              `json:"errors"`
+	Items  []json.RawMessage `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// bulkItemStatus returns the result of one item of a _bulk response, which is keyed by its operation.
+func bulkItemStatus(item json.RawMessage) bulkItemResult {
+	var results map[string]bulkItemResult
+	json.Unmarshal(item, &results)
+	for _, result := range results {
+		return result
+	}
+
+	return bulkItemResult{}
+}
+
+// decodeBulkResponse decodes a successful _bulk response, returning nil unless it has one result per item.
+func decodeBulkResponse(resp *http.Response, body []byte, count int) *bulkResponse {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	result := &bulkResponse{}
+	if err := json.Unmarshal(body, result); err != nil {
+		log.WithError(err).Warn("unable to decode bulk response")
+		return nil
+	}
+	if len(result.Items) != count {
+		log.WithField("items", len(result.Items)).WithField("expected", count).Warn("bulk response does not match request")
+		return nil
+	}
+
+	return result
+}
+
+// bulkChunk is the outcome of sending some of the items of a _bulk request.
+type bulkChunk struct {
+	resp *http.Response
+	// raw is the body of resp, already read
+	raw []byte
+	// result is decoded from raw, nil when it does not hold one result per item
+	result *bulkResponse
+	// merged reports whether result holds resubmitted items, and no longer matches raw
+	merged bool
+	err    error
+}
+
+// sendChunk sends items to upstream and resubmits those failing with a retryable status, merging
+// their results back in place.
+func (h *BulkHandler) sendChunk(r *http.Request, body *spool, items []bulkItem) *bulkChunk {
+	c := &bulkChunk{}
+	c.resp, c.raw, c.err = h.send(r, body, items)
+	if c.err != nil {
+		return c
+	}
+	c.result = decodeBulkResponse(c.resp, c.raw, len(items))
+	if c.result == nil {
+		return c
+	}
+
+	for attempt := 1; h.Retry != nil && attempt < h.Retry.MaxAttempts; attempt++ {
+		var failed []int
+		for i, item := range c.result.Items {
+			if containsInt(h.Retry.StatusCodes, bulkItemStatus(item).Status) {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) == 0 {
+			break
+		}
+
+		wait := h.Retry.backoff(attempt)
+		log.WithField("items", len(failed)).
+			WithField("total", len(items)).
+			WithField("attempt", attempt).
+			WithField("backoff", wait).
+			Warn("retrying failed bulk items")
+		for _, i := range failed {
+			bulkItemRetries.WithLabelValues(strconv.Itoa(bulkItemStatus(c.result.Items[i]).Status)).Inc()
+		}
+
+		if err := sleep(r.Context(), wait); err != nil {
+			break
+		}
+
+		retry := make([]bulkItem, len(failed))
+		for j, i := range failed {
+			retry[j] = items[i]
+		}
+		resp, raw, err := h.send(r, body, retry)
+		if err != nil {
+			// Answer with what was achieved so far, the items left keep their failed status
+			log.WithError(err).Warn("unable to retry failed bulk items")
+			break
+		}
+		retried := decodeBulkResponse(resp, raw, len(retry))
+		if retried == nil {
+			log.WithField("status_code", resp.StatusCode).Warn("unable to retry failed bulk items")
+			break
+		}
+
+		c.result.Took += retried.Took
+		for j, i := range failed {
+			c.result.Items[i] = retried.Items[j]
+		}
+		c.merged = true
+	}
+
+	return c
+}
+
+// send proxies a _bulk request made of items and reads its response.
+func (h *BulkHandler) send(r *http.Request, body *spool, items []bulkItem) (*http.Response, []byte, error) {
+	req := r.Clone(r.Context())
+	reqBody, size := bulkBody(body, items)
+	req.Body = io.NopCloser(reqBody)
+	req.ContentLength = size
+	// The response is parsed, let the transport negotiate and decode compression
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, raw, nil
+}
+
+// writeResponse answers with the status and headers of resp and the given body.
+func writeResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+	for k, vals := range resp.Header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
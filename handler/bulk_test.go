@@ -0,0 +1,321 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBulk(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+		err  error
+	}{
+		{
+			name: "should split actions and sources",
+			body: "{\"index\":{}}\n{\"a\":1}\n{\"delete\":{\"_id\":\"1\"}}\n{\"update\":{\"_id\":\"2\"}}\n{\"doc\":{}}\n",
+			want: []string{"{\"index\":{}}\n{\"a\":1}\n", "{\"delete\":{\"_id\":\"1\"}}\n", "{\"update\":{\"_id\":\"2\"}}\n{\"doc\":{}}\n"},
+		},
+		{
+			name: "should accept a missing final newline and blank lines",
+			body: "\n{\"create\":{}}\n{\"a\":1}",
+			want: []string{"{\"create\":{}}\n{\"a\":1}"},
+		},
+		{
+			name: "should reject unknown operations",
+			body: "{\"upsert\":{}}\n{}\n",
+			err:  fmt.Errorf("unknown bulk operation upsert"),
+		},
+		{
+			name: "should reject missing sources",
+			body: "{\"index\":{}}\n",
+			err:  fmt.Errorf("bulk index action at item 0 has no source line"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseBulk(strings.NewReader(tt.body))
+
+			if tt.err != nil {
+				assert.EqualError(t, err, tt.err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			got := make([]string, len(items))
+			for i, item := range items {
+				got[i] = tt.body[item.offset : item.offset+item.size]
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// bulkUpstream answers _bulk requests whose sources are plain words. Documents in failures fail
+// with a 429 as many times as given, and requests holding a document in rejects fail as a whole.
+type bulkUpstream struct {
+	failures map[string]int
+	rejects  map[string]int
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (b *bulkUpstream) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bodies = append(b.bodies, string(body))
+
+	items, err := parseBulk(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	result := bulkResponse{Took: 10}
+	for _, item := range items {
+		lines := bytes.SplitN(body[item.offset:item.offset+item.size], []byte("\n"), 2)
+		doc := strings.TrimSpace(string(lines[1]))
+		if status := b.rejects[doc]; status != 0 {
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(http.StatusText(status))),
+			}, nil
+		}
+		if b.failures[doc] > 0 {
+			b.failures[doc]--
+			result.Errors = true
+			result.Items = append(result.Items, json.RawMessage(fmt.Sprintf(`{%q:{"status":429,"error":{"type":"too_many_requests"}}}`, item.op)))
+		} else {
+			result.Items = append(result.Items, json.RawMessage(fmt.Sprintf(`{%q:{"status":201,"result":"created","doc":%q}}`, item.op, doc)))
+		}
+	}
+
+	out, _ := json.Marshal(result)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(out)),
+	}, nil
+}
+
+func TestBulkHandler_ServeHTTP(t *testing.T) {
+	body := "{\"index\":{}}\nA\n{\"index\":{}}\nB\n{\"index\":{}}\nC\n"
+
+	tests := []struct {
+		name        string
+		maxAttempts int
+		failures    map[string]int
+		wantBodies  []string
+		wantDocs    []string
+		wantErrors  bool
+		wantTook    int64
+	}{
+		{
+			name:        "should forward successful requests once",
+			maxAttempts: 3,
+			failures:    map[string]int{},
+			wantBodies:  []string{body},
+			wantDocs:    []string{"A", "B", "C"},
+			wantTook:    10,
+		},
+		{
+			name:        "should resubmit only failed items and merge them in order",
+			maxAttempts: 3,
+			failures:    map[string]int{"A": 1, "C": 2},
+			wantBodies:  []string{body, "{\"index\":{}}\nA\n{\"index\":{}}\nC\n", "{\"index\":{}}\nC\n"},
+			wantDocs:    []string{"A", "B", "C"},
+			wantTook:    30,
+		},
+		{
+			name:        "should report items still failing after the last attempt",
+			maxAttempts: 2,
+			failures:    map[string]int{"B": 5},
+			wantBodies:  []string{body, "{\"index\":{}}\nB\n"},
+			wantDocs:    []string{"A", "", "C"},
+			wantErrors:  true,
+			wantTook:    20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &bulkUpstream{failures: tt.failures}
+			h := &BulkHandler{
+				Client: upstream,
+				Next:   http.NotFoundHandler(),
+				Retry: &RetryPolicy{
+					MaxAttempts: tt.maxAttempts,
+					BaseBackoff: time.Millisecond,
+					StatusCodes: []int{http.StatusTooManyRequests},
+				},
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/logs/_bulk", strings.NewReader(body)))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.wantBodies, upstream.bodies)
+
+			var result struct {
+				Took   int64 `json:"took"`
+				Errors bool  `json:"errors"`
+				Items  []map[string]struct {
+					Doc string `json:"doc"`
+				} `json:"items"`
+			}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+			assert.Equal(t, tt.wantErrors, result.Errors)
+			assert.Equal(t, tt.wantTook, result.Took)
+			docs := make([]string, len(result.Items))
+			for i, item := range result.Items {
+				docs[i] = item["index"].Doc
+			}
+			assert.Equal(t, tt.wantDocs, docs)
+		})
+	}
+}
+
+func TestBulkHandler_ServeHTTPPassesThrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "should pass other APIs through", method: "POST", target: "/logs/_search", body: "{}"},
+		{name: "should pass filtered responses through", method: "POST", target: "/_bulk?filter_path=errors", body: "{\"delete\":{}}\n"},
+		{name: "should pass malformed bodies through", method: "POST", target: "/_bulk", body: "not json\n"},
+		{name: "should pass empty bodies through", method: "POST", target: "/_bulk", body: "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded string
+			h := &BulkHandler{
+				Client: &bulkUpstream{},
+				Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					b, _ := io.ReadAll(r.Body)
+					forwarded = string(b)
+				}),
+				Retry: &RetryPolicy{MaxAttempts: 3},
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.body, forwarded)
+		})
+	}
+}
+
+func TestBulkHandler_split(t *testing.T) {
+	items := []bulkItem{{size: 40}, {size: 40}, {size: 100}, {size: 10}, {size: 10}}
+
+	tests := []struct {
+		name          string
+		maxChunkSize  int64
+		maxChunkItems int
+		want          []int
+	}{
+		{name: "should keep a single chunk without limits", want: []int{5}},
+		{name: "should split on item count", maxChunkItems: 2, want: []int{2, 2, 1}},
+		{name: "should split on size and send oversized items alone", maxChunkSize: 80, want: []int{2, 1, 2}},
+		{name: "should apply the first limit reached", maxChunkSize: 120, maxChunkItems: 1, want: []int{1, 1, 1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BulkHandler{MaxChunkSize: tt.maxChunkSize, MaxChunkItems: tt.maxChunkItems}
+
+			var got []int
+			for _, chunk := range h.split(items) {
+				got = append(got, len(chunk))
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBulkHandler_ServeHTTPSplits(t *testing.T) {
+	body := "{\"index\":{}}\nA\n{\"delete\":{\"_id\":\"1\"}}\n{\"index\":{}}\nB\n{\"index\":{\"_id\":\"c\"}}\nC\n{\"index\":{}}\nD"
+
+	upstream := &bulkUpstream{rejects: map[string]int{"C": http.StatusRequestEntityTooLarge}}
+	h := &BulkHandler{
+		Client:        upstream,
+		Next:          http.NotFoundHandler(),
+		MaxChunkItems: 2,
+		Concurrency:   2,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/logs/_bulk", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json; charset=UTF-8", rec.Header().Get("Content-Type"))
+
+	sort.Strings(upstream.bodies)
+	assert.Equal(t, []string{
+		"{\"index\":{}}\nA\n{\"delete\":{\"_id\":\"1\"}}\n",
+		"{\"index\":{}}\nB\n{\"index\":{\"_id\":\"c\"}}\nC\n",
+		"{\"index\":{}}\nD\n",
+	}, upstream.bodies)
+
+	var result struct {
+		Took   int64 `json:"took"`
+		Errors bool  `json:"errors"`
+		Items  []map[string]struct {
+			Index  string `json:"_index"`
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+			Doc    string `json:"doc"`
+			Error  struct {
+				Type string `json:"type"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, int64(20), result.Took)
+	assert.True(t, result.Errors)
+	if assert.Len(t, result.Items, 5) {
+		assert.Equal(t, "A", result.Items[0]["index"].Doc)
+		assert.Equal(t, http.StatusCreated, result.Items[1]["delete"].Status)
+		for i, id := range []string{"", "c"} {
+			item := result.Items[2+i]["index"]
+			assert.Equal(t, http.StatusRequestEntityTooLarge, item.Status)
+			assert.Equal(t, "bulk_chunk_exception", item.Error.Type)
+			assert.Equal(t, "logs", item.Index)
+			assert.Equal(t, id, item.ID)
+		}
+		assert.Equal(t, "D", result.Items[4]["index"].Doc)
+	}
+}
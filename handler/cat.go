@@ -0,0 +1,554 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CatHandler answers the _cat APIs AOSS does not support, _cat/indices, _cat/aliases, _cat/count,
+// _cat/health and _cat/nodes, from signed requests to upstream where it has the data and from the
+// same synthetic values as the other intercepted endpoints otherwise.
+type CatHandler struct {
+	Client Client
+	// Host is the upstream host, the incoming Host header is used when empty.
+	Host string
+	// HealthStatus returns the health of the cluster behind host, nil reports green.
+	HealthStatus func(host string) string
+}
+
+func (h *CatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || len(segments) > 3 || segments[0] != "_cat" {
+		http.NotFound(w, r)
+		return
+	}
+	target := ""
+	if len(segments) == 3 {
+		target = segments[2]
+	}
+
+	log.WithField("path", r.URL.Path).Debug("Intercepted _cat")
+
+	var table *catTable
+	var err error
+	switch segments[1] {
+	case "indices":
+		table, err = h.indices(r, target)
+	case "aliases":
+		table, err = h.aliases(r, target)
+	case "count":
+		table, err = h.count(r, target)
+	case "health":
+		table = h.health(r)
+	case "nodes":
+		table = catNodes()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+
+	table.write(w, r)
+}
+
+func (h *CatHandler) host(r *http.Request) string {
+	if h.Host != "" {
+		return h.Host
+	}
+
+	return r.Host
+}
+
+// indices lists the indices matching target and their document counts.
+func (h *CatHandler) indices(r *http.Request, target string) (*catTable, error) {
+	indices, err := countIndexDocs(r.Context(), h.Client, h.host(r), target)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &catTable{columns: []catColumn{
+		{name: "health", aliases: []string{"h"}},
+		{name: "status", aliases: []string{"s"}},
+		{name: "index", aliases: []string{"i", "idx"}},
+		{name: "uuid", aliases: []string{"id"}},
+		{name: "pri", aliases: []string{"p", "shards.primary"}, kind: catNumber},
+		{name: "rep", aliases: []string{"r", "shards.replica"}, kind: catNumber},
+		{name: "docs.count", aliases: []string{"dc", "docsCount"}, kind: catNumber},
+		{name: "docs.deleted", aliases: []string{"dd", "docsDeleted"}, kind: catNumber},
+		{name: "store.size", aliases: []string{"ss", "storeSize"}, kind: catBytes},
+		{name: "pri.store.size", kind: catBytes},
+	}}
+	for _, index := range indices {
+		// AOSS reports neither shards nor store sizes, they are made up like _stats
+		table.rows = append(table.rows, []interface{}{"green", "open", index.name, "_na_", int64(1), int64(0), index.count, int64(0), int64(0), int64(0)})
+	}
+
+	return table, nil
+}
+
+// aliasSpec is an alias in a GET _aliases response.
+type aliasSpec struct {
+	Filter        json.RawMessage `json:"filter"`
+	IndexRouting  string          `json:"index_routing"`
+	SearchRouting string          `json:"search_routing"`
+	IsWriteIndex  *bool           `json:"is_write_index"`
+}
+
+// aliases lists the aliases whose name matches one of the comma separated patterns of target.
+func (h *CatHandler) aliases(r *http.Request, target string) (*catTable, error) {
+	var indices map[string]struct {
+		Aliases map[string]aliasSpec `json:"aliases"`
+	}
+	if err := getJSON(r.Context(), h.Client, h.host(r), "/_aliases", &indices); err != nil {
+		return nil, err
+	}
+
+	table := &catTable{columns: []catColumn{
+		{name: "alias", aliases: []string{"a"}},
+		{name: "index", aliases: []string{"i", "idx"}},
+		{name: "filter", aliases: []string{"f", "fi"}},
+		{name: "routing.index", aliases: []string{"ri", "routingIndex"}},
+		{name: "routing.search", aliases: []string{"rs", "routingSearch"}},
+		{name: "is_write_index", aliases: []string{"w", "isWriteIndex"}},
+	}}
+	for index, spec := range indices {
+		for alias, a := range spec.Aliases {
+			if target != "" && !matchAny(strings.Split(target, ","), alias) {
+				continue
+			}
+
+			filter := "-"
+			if len(a.Filter) > 0 {
+				filter = "*"
+			}
+			isWriteIndex := "-"
+			if a.IsWriteIndex != nil {
+				isWriteIndex = strconv.FormatBool(*a.IsWriteIndex)
+			}
+			table.rows = append(table.rows, []interface{}{alias, index, filter, orDash(a.IndexRouting), orDash(a.SearchRouting), isWriteIndex})
+		}
+	}
+	sort.Slice(table.rows, func(i, j int) bool {
+		if a, b := table.rows[i][0].(string), table.rows[j][0].(string); a != b {
+			return a < b
+		}
+		return table.rows[i][1].(string) < table.rows[j][1].(string)
+	})
+
+	return table, nil
+}
+
+// count counts the documents of the indices matching target.
+func (h *CatHandler) count(r *http.Request, target string) (*catTable, error) {
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	if err := getJSON(r.Context(), h.Client, h.host(r), indexPath(target, "_count"), &count); err != nil {
+		return nil, err
+	}
+
+	epoch, timestamp := catTime(time.Now())
+	return &catTable{
+		columns: []catColumn{
+			{name: "epoch", aliases: []string{"t", "time"}, kind: catNumber},
+			{name: "timestamp", aliases: []string{"ts", "hms", "hhmmss"}},
+			{name: "count", aliases: []string{"dc", "docs.count", "docsCount"}, kind: catNumber},
+		},
+		rows: [][]interface{}{{epoch, timestamp, count.Count}},
+	}, nil
+}
+
+// health reports the same health as _cluster/health.
+func (h *CatHandler) health(r *http.Request) *catTable {
+	status := "green"
+	if h.HealthStatus != nil {
+		status = h.HealthStatus(h.host(r))
+	}
+	health := newHealth(status)
+
+	epoch, timestamp := catTime(time.Now())
+	return &catTable{
+		columns: []catColumn{
+			{name: "epoch", aliases: []string{"t", "time"}, kind: catNumber},
+			{name: "timestamp", aliases: []string{"ts", "hms", "hhmmss"}},
+			{name: "cluster", aliases: []string{"cl"}},
+			{name: "status", aliases: []string{"st"}},
+			{name: "node.total", aliases: []string{"nt", "nodeTotal"}, kind: catNumber},
+			{name: "node.data", aliases: []string{"nd", "nodeData"}, kind: catNumber},
+			{name: "discovered_cluster_manager", aliases: []string{"dcm"}},
+			{name: "shards", aliases: []string{"sh", "shards.total", "shardsTotal"}, kind: catNumber},
+			{name: "pri", aliases: []string{"p", "shards.primary", "shardsPrimary"}, kind: catNumber},
+			{name: "relo", aliases: []string{"r", "shards.relocating", "shardsRelocating"}, kind: catNumber},
+			{name: "init", aliases: []string{"i", "shards.initializing", "shardsInitializing"}, kind: catNumber},
+			{name: "unassign", aliases: []string{"u", "shards.unassigned", "shardsUnassigned"}, kind: catNumber},
+			{name: "pending_tasks", aliases: []string{"pt", "pendingTasks"}, kind: catNumber},
+			{name: "max_task_wait_time", aliases: []string{"mtwt", "maxTaskWaitTime"}},
+			{name: "active_shards_percent", aliases: []string{"asp", "activeShardsPercent"}},
+		},
+		rows: [][]interface{}{{
+			epoch, timestamp, health.ClusterName, health.Status,
+			int64(health.NumberOfNodes), int64(health.NumberOfDataNodes), "true",
+			int64(health.ActiveShards), int64(health.ActivePrimaryShards), int64(health.RelocatingShards),
+			int64(health.InitializingShards), int64(health.UnassignedShards), int64(health.NumberOfPendingTasks),
+			"-", fmt.Sprintf("%.1f%%", health.ActiveShardsPercentAsNumber*100),
+		}},
+	}
+}
+
+// catNodes reports the node made up by _nodes.
+func catNodes() *catTable {
+	return &catTable{
+		columns: []catColumn{
+			{name: "ip", aliases: []string{"i"}},
+			{name: "heap.percent", aliases: []string{"hp", "heapPercent"}, kind: catNumber},
+			{name: "ram.percent", aliases: []string{"rp", "ramPercent"}, kind: catNumber},
+			{name: "cpu", kind: catNumber},
+			{name: "load_1m", aliases: []string{"l"}},
+			{name: "load_5m", aliases: []string{"l"}},
+			{name: "load_15m", aliases: []string{"l"}},
+			{name: "node.role", aliases: []string{"r", "role", "nodeRole"}},
+			{name: "cluster_manager", aliases: []string{"m"}},
+			{name: "name", aliases: []string{"n"}},
+		},
+		rows: [][]interface{}{{"127.0.0.1", int64(0), int64(0), int64(0), "0.00", "0.00", "0.00", "dimr", "*", "node"}},
+	}
+}
+
+func catTime(t time.Time) (int64, string) {
+	return t.Unix(), t.UTC().Format("15:04:05")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// matchAny tells whether name matches one of the wildcard patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type catKind int
+
+const (
+	catText catKind = iota
+	catNumber
+	catBytes
+)
+
+// catColumn is a column of a _cat table. Numbers are right aligned and sorted numerically, byte sizes
+// are also formatted according to the bytes parameter.
+type catColumn struct {
+	name    string
+	aliases []string
+	kind    catKind
+}
+
+func (c catColumn) matches(header string) bool {
+	if ok, _ := path.Match(header, c.name); ok {
+		return true
+	}
+	for _, alias := range c.aliases {
+		if alias == header {
+			return true
+		}
+	}
+
+	return false
+}
+
+// catTable holds rows of strings and, for number and byte size columns, int64s.
+type catTable struct {
+	columns []catColumn
+	rows    [][]interface{}
+}
+
+// write answers with the table in the text or JSON format, with the columns, sorting and units of the
+// v, h, s, format and bytes parameters.
+func (t *catTable) write(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	columns, err := t.selectColumns(query.Get("h"))
+	if err == nil {
+		err = t.sort(query.Get("s"))
+	}
+	var cells [][]string
+	if err == nil {
+		cells, err = t.format(columns, query.Get("bytes"))
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v - %v", "invalid _cat parameters", err), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	switch query.Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		writeCatJSON(&buf, t.columns, columns, cells)
+	case "", "text", "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		_, verbose := query["v"]
+		if verbose && query.Get("v") == "false" {
+			verbose = false
+		}
+		writeCatText(&buf, t.columns, columns, cells, verbose)
+	default:
+		http.Error(w, fmt.Sprintf("%v - %v", "invalid _cat parameters", fmt.Errorf("unsupported format [%s]", query.Get("format"))), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// selectColumns returns the indexes of the columns named by the comma separated names, aliases or
+// wildcard patterns of h, all of them when empty.
+func (t *catTable) selectColumns(h string) ([]int, error) {
+	var columns []int
+	if h == "" {
+		for i := range t.columns {
+			columns = append(columns, i)
+		}
+		return columns, nil
+	}
+
+	for _, header := range strings.Split(h, ",") {
+		found := false
+		for i, column := range t.columns {
+			if column.matches(header) {
+				columns = append(columns, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column [%s]", header)
+		}
+	}
+
+	return columns, nil
+}
+
+// sort orders the rows by the comma separated columns of s, each optionally followed by :asc or :desc.
+func (t *catTable) sort(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	type key struct {
+		column int
+		desc   bool
+	}
+	var keys []key
+	for _, field := range strings.Split(s, ",") {
+		name, order := field, "asc"
+		if i := strings.LastIndex(field, ":"); i >= 0 {
+			name, order = field[:i], field[i+1:]
+		}
+		if order != "asc" && order != "desc" {
+			return fmt.Errorf("invalid sort order [%s]", order)
+		}
+
+		column := -1
+		for i, c := range t.columns {
+			if c.name == name || c.matches(name) {
+				column = i
+				break
+			}
+		}
+		if column < 0 {
+			return fmt.Errorf("unable to sort by unknown column [%s]", name)
+		}
+		keys = append(keys, key{column: column, desc: order == "desc"})
+	}
+
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		for _, k := range keys {
+			c := compareCell(t.rows[i][k.column], t.rows[j][k.column])
+			if c == 0 {
+				continue
+			}
+			if k.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	return nil
+}
+
+func compareCell(a, b interface{}) int {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// format renders the cells of the selected columns, byte sizes in the unit of bytes or human readable.
+func (t *catTable) format(columns []int, unit string) ([][]string, error) {
+	cells := make([][]string, 0, len(t.rows))
+	for _, row := range t.rows {
+		line := make([]string, 0, len(columns))
+		for _, i := range columns {
+			value := row[i]
+			if n, ok := value.(int64); ok && t.columns[i].kind == catBytes {
+				s, err := formatBytes(n, unit)
+				if err != nil {
+					return nil, err
+				}
+				line = append(line, s)
+				continue
+			}
+			line = append(line, fmt.Sprint(value))
+		}
+		cells = append(cells, line)
+	}
+
+	return cells, nil
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"pb", 1 << 50},
+	{"tb", 1 << 40},
+	{"gb", 1 << 30},
+	{"mb", 1 << 20},
+	{"kb", 1 << 10},
+	{"b", 1},
+}
+
+// formatBytes renders n as a whole number of unit, such as kb, or in the largest unit it reaches with
+// one decimal, such as 1.5mb, when unit is empty.
+func formatBytes(n int64, unit string) (string, error) {
+	if unit == "" {
+		for _, u := range byteUnits {
+			if n >= u.size || u.size == 1 {
+				s := strconv.FormatFloat(float64(n)/float64(u.size), 'f', 1, 64)
+				return strings.TrimSuffix(s, ".0") + u.suffix, nil
+			}
+		}
+	}
+
+	for _, u := range byteUnits {
+		if unit == u.suffix || unit+"b" == u.suffix {
+			return strconv.FormatInt(n/u.size, 10), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid bytes unit [%s]", unit)
+}
+
+func writeCatJSON(buf *bytes.Buffer, all []catColumn, columns []int, cells [][]string) {
+	buf.WriteByte('[')
+	for r, line := range cells {
+		if r > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		for c, cell := range line {
+			if c > 0 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(all[columns[c]].name)
+			value, _ := json.Marshal(cell)
+			buf.Write(name)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(']')
+}
+
+func writeCatText(buf *bytes.Buffer, all []catColumn, columns []int, cells [][]string, verbose bool) {
+	widths := make([]int, len(columns))
+	if verbose {
+		for c, i := range columns {
+			widths[c] = len(all[i].name)
+		}
+	}
+	for _, line := range cells {
+		for c, cell := range line {
+			if len(cell) > widths[c] {
+				widths[c] = len(cell)
+			}
+		}
+	}
+
+	writeLine := func(line []string, header bool) {
+		var s strings.Builder
+		for c, cell := range line {
+			if c > 0 {
+				s.WriteByte(' ')
+			}
+			pad := strings.Repeat(" ", widths[c]-len(cell))
+			if !header && all[columns[c]].kind != catText {
+				s.WriteString(pad + cell)
+			} else {
+				s.WriteString(cell + pad)
+			}
+		}
+		buf.WriteString(strings.TrimRight(s.String(), " "))
+		buf.WriteByte('\n')
+	}
+
+	if verbose {
+		header := make([]string, len(columns))
+		for c, i := range columns {
+			header[c] = all[i].name
+		}
+		writeLine(header, true)
+	}
+	for _, line := range cells {
+		writeLine(line, false)
+	}
+}
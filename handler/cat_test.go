@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jsonUpstream answers GET requests with the JSON document registered for their path, and with an
+// index_not_found_exception otherwise.
+type jsonUpstream struct {
+	mu        sync.Mutex
+	responses map[string]string
+	requested []string
+}
+
+func (u *jsonUpstream) Do(req *http.Request) (*http.Response, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requested = append(u.requested, req.Method+" "+req.URL.String())
+
+	status, body := http.StatusOK, u.responses[req.URL.String()]
+	if body == "" {
+		status, body = http.StatusNotFound, `{"error":{"type":"index_not_found_exception"},"status":404}`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestCatHandler_ServeHTTP(t *testing.T) {
+	upstream := &jsonUpstream{responses: map[string]string{
+		"/_mapping":         `{"logs-b":{"mappings":{}},"logs-a":{"mappings":{}},"metrics":{"mappings":{}}}`,
+		"/logs-*/_mapping":  `{"logs-b":{"mappings":{}},"logs-a":{"mappings":{}}}`,
+		"/logs-a/_count":    `{"count":1200}`,
+		"/logs-b/_count":    `{"count":35}`,
+		"/metrics/_count":   `{"count":7}`,
+		"/_count":           `{"count":1242}`,
+		"/_aliases":         `{"logs-a":{"aliases":{"logs":{"is_write_index":true},"recent":{"filter":{"range":{}}}}},"metrics":{"aliases":{}}}`,
+		"/metrics/_mapping": `{"metrics":{"mappings":{}}}`,
+	}}
+	h := &CatHandler{Client: upstream, HealthStatus: func(host string) string { return "yellow" }}
+
+	tests := []struct {
+		name        string
+		target      string
+		status      int
+		contentType string
+		want        string
+	}{
+		{
+			name:        "should list indices with their document counts",
+			target:      "/_cat/indices?v&h=index,docs.count,store.size",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=UTF-8",
+			want:        "index   docs.count store.size\nlogs-a        1200         0b\nlogs-b          35         0b\nmetrics          7         0b\n",
+		},
+		{
+			name:   "should list the indices matching the target, sorted by a column",
+			target: "/_cat/indices/logs-*?h=i,dc&s=dc:desc",
+			status: http.StatusOK,
+			want:   "logs-a 1200\nlogs-b   35\n",
+		},
+		{
+			name:        "should answer in JSON",
+			target:      "/_cat/indices/metrics?format=json&h=index,docs.count,pri.store.size&bytes=kb",
+			status:      http.StatusOK,
+			contentType: "application/json; charset=UTF-8",
+			want:        `[{"index":"metrics","docs.count":"7","pri.store.size":"0"}]`,
+		},
+		{
+			name:   "should relay upstream errors",
+			target: "/_cat/indices/missing",
+			status: http.StatusNotFound,
+			want:   `{"error":{"type":"index_not_found_exception"},"status":404}`,
+		},
+		{
+			name:   "should list aliases",
+			target: "/_cat/aliases?v",
+			status: http.StatusOK,
+			want:   "alias  index  filter routing.index routing.search is_write_index\nlogs   logs-a -      -             -              true\nrecent logs-a *      -             -              -\n",
+		},
+		{
+			name:   "should list the aliases matching the target",
+			target: "/_cat/aliases/rec*?h=alias",
+			status: http.StatusOK,
+			want:   "recent\n",
+		},
+		{
+			name:   "should count documents",
+			target: "/_cat/count?h=count",
+			status: http.StatusOK,
+			want:   "1242\n",
+		},
+		{
+			name:   "should report the cluster health",
+			target: "/_cat/health?h=cluster,status,node.total",
+			status: http.StatusOK,
+			want:   "serverless yellow 1\n",
+		},
+		{
+			name:   "should report the node",
+			target: "/_cat/nodes?h=name,m",
+			status: http.StatusOK,
+			want:   "node *\n",
+		},
+		{
+			name:   "should reject unknown columns",
+			target: "/_cat/count?h=bogus",
+			status: http.StatusBadRequest,
+			want:   "invalid _cat parameters - unknown column [bogus]\n",
+		},
+		{
+			name:   "should reject unknown byte units",
+			target: "/_cat/indices?bytes=xb",
+			status: http.StatusBadRequest,
+			want:   "invalid _cat parameters - invalid bytes unit [xb]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.want, rec.Body.String())
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		unit string
+		want string
+	}{
+		{n: 0, want: "0b"},
+		{n: 1023, want: "1023b"},
+		{n: 1536, want: "1.5kb"},
+		{n: 5 << 30, want: "5gb"},
+		{n: 5 << 30, unit: "mb", want: "5120"},
+		{n: 1536, unit: "k", want: "1"},
+	}
+
+	for _, tt := range tests {
+		got, err := formatBytes(tt.n, tt.unit)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+}
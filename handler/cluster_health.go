@@ -0,0 +1,181 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless/opensearchserverlessiface"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// aossHostSuffix ends the data-plane host of every AOSS collection, <id>.<region>.aoss.amazonaws.com.
+	aossHostSuffix = ".aoss.amazonaws.com"
+
+	// collectionNotFound is the status of a collection the control plane does not know about.
+	collectionNotFound = "NOT_FOUND"
+)
+
+// ParseCollectionHost returns the collection ID and region of an AOSS collection endpoint.
+func ParseCollectionHost(host string) (id, region string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(host), aossHostSuffix), ".")
+	if !strings.HasSuffix(strings.ToLower(host), aossHostSuffix) || len(labels) != 2 {
+		return "", "", false
+	}
+
+	return labels[0], labels[1], true
+}
+
+// ClusterHealth answers _cluster/health from the state of the AOSS collection behind the request,
+// as reported by the control plane and by a signed probe of the data plane. The result is
+// cached for TTL.
+type ClusterHealth struct {
+	// Collections returns the client looking collections up on the control plane of a region, nil
+	// only relies on Probe. It is called once per region.
+	Collections func(region string) opensearchserverlessiface.OpenSearchServerlessAPI
+	// Probe makes a signed request to the data plane of host, nil only relies on Collections.
+	Probe func(ctx context.Context, host string) error
+	// Host is the upstream host, the incoming Host header is used when empty.
+	Host string
+	TTL  time.Duration
+
+	cache ttlCache[string, string]
+
+	mu      sync.Mutex
+	regions map[string]opensearchserverlessiface.OpenSearchServerlessAPI
+}
+
+func (h *ClusterHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := h.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	writeHealth(w, newHealth(h.Status(host)))
+}
+
+// Status returns the cached health of host, computing it again once expired. Concurrent requests
+// for the same host wait for a single computation.
+func (h *ClusterHealth) Status(host string) string {
+	status, _ := h.cache.get(context.Background(), host, h.TTL, func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultProbeTimeout)
+		defer cancel()
+		return h.compute(ctx, host), nil
+	})
+
+	return status
+}
+
+func (h *ClusterHealth) compute(ctx context.Context, host string) string {
+	collection := ""
+	if id, region, ok := ParseCollectionHost(host); ok && h.Collections != nil {
+		var err error
+		collection, err = h.collectionStatus(ctx, h.collections(region), id)
+		if err != nil {
+			log.WithError(err).WithField("collection", id).Warn("unable to get collection status")
+		}
+	}
+
+	probed := false
+	if h.Probe != nil {
+		err := h.Probe(ctx, host)
+		if err != nil {
+			log.WithError(err).WithField("host", host).Warn("upstream health probe failed")
+		}
+		probed = err == nil
+	}
+
+	status := healthStatus(collection, h.Probe != nil, probed)
+	log.WithFields(log.Fields{"host": host, "collection_status": collection, "probed": probed, "status": status}).Debug("computed cluster health")
+
+	return status
+}
+
+// collections returns the control-plane client of region, collections of other regions are not found.
+func (h *ClusterHealth) collections(region string) opensearchserverlessiface.OpenSearchServerlessAPI {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.regions == nil {
+		h.regions = map[string]opensearchserverlessiface.OpenSearchServerlessAPI{}
+	}
+	client, ok := h.regions[region]
+	if !ok {
+		client = h.Collections(region)
+		h.regions[region] = client
+	}
+
+	return client
+}
+
+// collectionStatus returns the status of a collection, such as ACTIVE, or NOT_FOUND.
+func (h *ClusterHealth) collectionStatus(ctx context.Context, collections opensearchserverlessiface.OpenSearchServerlessAPI, id string) (string, error) {
+	out, err := collections.BatchGetCollectionWithContext(ctx, &opensearchserverless.BatchGetCollectionInput{
+		Ids: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, detail := range out.CollectionDetails {
+		if aws.StringValue(detail.Id) == id {
+			return aws.StringValue(detail.Status), nil
+		}
+	}
+	for _, detail := range out.CollectionErrorDetails {
+		if aws.StringValue(detail.ErrorCode) != collectionNotFound {
+			return "", fmt.Errorf("%s: %s", aws.StringValue(detail.ErrorCode), aws.StringValue(detail.ErrorMessage))
+		}
+	}
+
+	return collectionNotFound, nil
+}
+
+// healthStatus maps the collection status and the outcome of the data-plane probe, when made, to
+// a cluster health color. An empty collection status means the control plane could not tell.
+func healthStatus(collection string, probe, probed bool) string {
+	switch collection {
+	case opensearchserverless.CollectionStatusActive:
+		// The collection is fine but cannot be reached, the access policy may be broken
+		if probe && !probed {
+			return "yellow"
+		}
+		return "green"
+	case opensearchserverless.CollectionStatusCreating:
+		return "yellow"
+	case opensearchserverless.CollectionStatusDeleting, opensearchserverless.CollectionStatusFailed, collectionNotFound:
+		return "red"
+	}
+
+	if probed {
+		return "green"
+	}
+
+	return "red"
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless"
+	"github.com/aws/aws-sdk-go/service/opensearchserverless/opensearchserverlessiface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCollectionHost(t *testing.T) {
+	tests := []struct {
+		host       string
+		wantID     string
+		wantRegion string
+		wantOK     bool
+	}{
+		{host: "abcdefgh.us-east-1.aoss.amazonaws.com", wantID: "abcdefgh", wantRegion: "us-east-1", wantOK: true},
+		{host: "ABCDEFGH.eu-west-1.aoss.amazonaws.com:443", wantID: "abcdefgh", wantRegion: "eu-west-1", wantOK: true},
+		{host: "aoss.us-east-1.amazonaws.com"},
+		{host: "search-domain.us-east-1.es.amazonaws.com"},
+		{host: "logs.local"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			id, region, ok := ParseCollectionHost(tt.host)
+
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantRegion, region)
+			assert.Equal(t, tt.wantOK, ok)
+		})
+	}
+}
+
+// fakeControlPlane answers BatchGetCollection with the given collection status, NOT_FOUND when empty,
+// or fails with the given status code.
+type fakeControlPlane struct {
+	status     string
+	statusCode int
+	calls      int32
+
+	mu      sync.Mutex
+	regions []string
+}
+
+func (f *fakeControlPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.calls, 1)
+
+	// The region of the credential scope, Credential=AKID/<date>/<region>/aoss/aws4_request
+	if scope := strings.Split(r.Header.Get("Authorization"), "/"); len(scope) > 2 {
+		f.mu.Lock()
+		f.regions = append(f.regions, scope[2])
+		f.mu.Unlock()
+	}
+
+	if r.Header.Get("X-Amz-Target") != "OpenSearchServerless.BatchGetCollection" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var input struct {
+		IDs []string `json:"ids"`
+	}
+	b, _ := io.ReadAll(r.Body)
+	json.Unmarshal(b, &input)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if f.statusCode != 0 {
+		w.WriteHeader(f.statusCode)
+		fmt.Fprint(w, `{"__type":"AccessDeniedException","message":"not allowed"}`)
+		return
+	}
+
+	if f.status == "" {
+		fmt.Fprintf(w, `{"collectionDetails":[],"collectionErrorDetails":[{"id":%q,"errorCode":"NOT_FOUND","errorMessage":"not found"}]}`, input.IDs[0])
+		return
+	}
+	fmt.Fprintf(w, `{"collectionDetails":[{"id":%q,"name":"logs","status":%q}],"collectionErrorDetails":[]}`, input.IDs[0], f.status)
+}
+
+// newFakeCollections returns control-plane clients of cp, whatever their region.
+func newFakeCollections(t *testing.T, cp *fakeControlPlane) func(region string) opensearchserverlessiface.OpenSearchServerlessAPI {
+	server := httptest.NewServer(cp)
+	t.Cleanup(server.Close)
+
+	return func(region string) opensearchserverlessiface.OpenSearchServerlessAPI {
+		sess := session.Must(session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Endpoint:    aws.String(server.URL),
+			Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+			MaxRetries:  aws.Int(0),
+		}))
+
+		return opensearchserverless.New(sess)
+	}
+}
+
+func TestClusterHealth_ServeHTTP(t *testing.T) {
+	probeOK := func(ctx context.Context, host string) error { return nil }
+	probeFails := func(ctx context.Context, host string) error { return fmt.Errorf("upstream answered 403") }
+
+	tests := []struct {
+		name         string
+		controlPlane *fakeControlPlane
+		probe        func(ctx context.Context, host string) error
+		want         string
+	}{
+		{name: "should be green when the collection is active", controlPlane: &fakeControlPlane{status: "ACTIVE"}, want: "green"},
+		{name: "should be green when the collection is active and reachable", controlPlane: &fakeControlPlane{status: "ACTIVE"}, probe: probeOK, want: "green"},
+		{name: "should be yellow when the collection is active but unreachable", controlPlane: &fakeControlPlane{status: "ACTIVE"}, probe: probeFails, want: "yellow"},
+		{name: "should be yellow while the collection is created", controlPlane: &fakeControlPlane{status: "CREATING"}, want: "yellow"},
+		{name: "should be red when the collection is deleting", controlPlane: &fakeControlPlane{status: "DELETING"}, probe: probeOK, want: "red"},
+		{name: "should be red when the collection failed", controlPlane: &fakeControlPlane{status: "FAILED"}, want: "red"},
+		{name: "should be red when the collection does not exist", controlPlane: &fakeControlPlane{}, want: "red"},
+		{name: "should count a successful probe when the control plane fails", controlPlane: &fakeControlPlane{statusCode: http.StatusForbidden}, probe: probeOK, want: "green"},
+		{name: "should be red when nothing succeeds", controlPlane: &fakeControlPlane{statusCode: http.StatusForbidden}, probe: probeFails, want: "red"},
+		{name: "should rely on the probe alone", probe: probeOK, want: "green"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ClusterHealth{
+				Probe: tt.probe,
+				Host:  "abcdefgh.us-east-1.aoss.amazonaws.com",
+				TTL:   time.Minute,
+			}
+			if tt.controlPlane != nil {
+				h.Collections = newFakeCollections(t, tt.controlPlane)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/_cluster/health", nil))
+
+			var health Health
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.want, health.Status)
+		})
+	}
+}
+
+func TestClusterHealth_ServeHTTPCaches(t *testing.T) {
+	cp := &fakeControlPlane{status: "CREATING"}
+	h := &ClusterHealth{Collections: newFakeCollections(t, cp), TTL: time.Hour}
+
+	statuses := []string{}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Expire the cached status
+			cp.status = "ACTIVE"
+			ready := make(chan struct{})
+			close(ready)
+			h.cache.entries["abcdefgh.us-east-1.aoss.amazonaws.com"] = &ttlEntry[string]{ready: ready, value: "yellow"}
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/_cluster/health", nil)
+		req.Host = "abcdefgh.us-east-1.aoss.amazonaws.com"
+		h.ServeHTTP(rec, req)
+
+		var health Health
+		json.Unmarshal(rec.Body.Bytes(), &health)
+		statuses = append(statuses, health.Status)
+	}
+
+	assert.Equal(t, []string{"yellow", "yellow", "green"}, statuses)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cp.calls))
+}
+
+func TestClusterHealth_StatusPerHost(t *testing.T) {
+	unblock := make(chan struct{})
+	var probes int32
+	h := &ClusterHealth{
+		Probe: func(ctx context.Context, host string) error {
+			atomic.AddInt32(&probes, 1)
+			if host == "slow.host" {
+				<-unblock
+			}
+			return nil
+		},
+		TTL: time.Millisecond,
+	}
+
+	done := make(chan string)
+	go func() { done <- h.Status("slow.host") }()
+
+	// Other hosts are not held up by a slow probe
+	assert.Equal(t, "green", h.Status("fast.host"))
+
+	close(unblock)
+	assert.Equal(t, "green", <-done)
+
+	// Expired hosts are dropped from the cache
+	time.Sleep(2 * time.Millisecond)
+	h.Status("other.host")
+	h.cache.mu.Lock()
+	assert.Len(t, h.cache.entries, 1)
+	h.cache.mu.Unlock()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&probes))
+}
+
+func TestClusterHealth_StatusPerRegion(t *testing.T) {
+	cp := &fakeControlPlane{status: "ACTIVE"}
+	collections := newFakeCollections(t, cp)
+	created := []string{}
+	h := &ClusterHealth{
+		Collections: func(region string) opensearchserverlessiface.OpenSearchServerlessAPI {
+			created = append(created, region)
+			return collections(region)
+		},
+		TTL: time.Minute,
+	}
+
+	// Collections are looked up in the region of their host
+	for _, host := range []string{"abcdefgh.us-east-1.aoss.amazonaws.com", "ijklmnop.eu-west-1.aoss.amazonaws.com", "qrstuvwx.eu-west-1.aoss.amazonaws.com"} {
+		assert.Equal(t, "green", h.Status(host))
+	}
+
+	assert.Equal(t, []string{"us-east-1", "eu-west-1"}, created)
+	assert.Equal(t, []string{"us-east-1", "eu-west-1", "eu-west-1"}, cp.regions)
+}
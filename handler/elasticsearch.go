@@ -0,0 +1,105 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// elasticVendorPrefix starts the subtype of Elasticsearch vendor media types, such as
+	// application/vnd.elasticsearch+json; compatible-with=7.
+	elasticVendorPrefix = "vnd.elasticsearch+"
+
+	elasticProductHeader = "X-Elastic-Product"
+)
+
+// ElasticsearchInfo is the identity reported to Elasticsearch clients, which check for an
+// Elasticsearch 7 compatible version before connecting.
+func ElasticsearchInfo() Info {
+	info := DefaultInfo()
+	info.Version.Distribution = ""
+	info.Version.Number = "7.10.2"
+	info.Version.BuildFlavor = "default"
+	info.Version.LuceneVersion = "8.7.0"
+	info.Version.MinimumWireCompatibilityVersion = "6.8.0"
+	info.Version.MinimumIndexCompatibilityVersion = "6.0.0-beta1"
+	info.TagLine = "You Know, for Search"
+
+	return info
+}
+
+// ElasticsearchProduct adds the header Elasticsearch clients check to every response, including
+// the ones answered by the proxy itself.
+func ElasticsearchProduct(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(elasticProductHeader, "Elasticsearch")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteElasticMediaTypes replaces the Elasticsearch vendor media types of the Accept and
+// Content-Type headers, which upstream rejects, with the plain ones they stand for.
+func rewriteElasticMediaTypes(h http.Header) {
+	for _, name := range []string{"Accept", "Content-Type"} {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		rewritten := make([]string, len(values))
+		changed := false
+		for i, v := range values {
+			rewritten[i] = rewriteElasticMediaType(v)
+			changed = changed || rewritten[i] != v
+		}
+		if changed {
+			log.WithField("header", name).WithField("from", values).WithField("to", rewritten).Debug("rewriting Elasticsearch media type")
+			h[http.CanonicalHeaderKey(name)] = rewritten
+		}
+	}
+}
+
+// rewriteElasticMediaType maps every media type of a header value such as
+// application/vnd.elasticsearch+x-ndjson; compatible-with=7 to application/x-ndjson, keeping other
+// parameters than compatible-with.
+func rewriteElasticMediaType(value string) string {
+	if !strings.Contains(value, elasticVendorPrefix) {
+		return value
+	}
+
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		slash := strings.Index(mediaType, "/")
+		if slash < 0 || !strings.HasPrefix(mediaType[slash+1:], elasticVendorPrefix) {
+			continue
+		}
+
+		delete(params, "compatible-with")
+		parts[i] = mime.FormatMediaType(mediaType[:slash+1]+strings.TrimPrefix(mediaType[slash+1:], elasticVendorPrefix), params)
+	}
+
+	return strings.Join(parts, ",")
+}
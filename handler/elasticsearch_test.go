@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteElasticMediaType(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "application/vnd.elasticsearch+json; compatible-with=7", want: "application/json"},
+		{value: "application/vnd.elasticsearch+x-ndjson;compatible-with=8", want: "application/x-ndjson"},
+		{value: "application/vnd.elasticsearch+json; compatible-with=7; charset=utf-8", want: "application/json; charset=utf-8"},
+		{value: "text/vnd.elasticsearch+plain; compatible-with=7, application/json", want: "text/plain, application/json"},
+		{value: "application/json", want: "application/json"},
+		{value: "*/*", want: "*/*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.want, rewriteElasticMediaType(tt.value))
+		})
+	}
+}
+
+func TestElasticsearchProduct(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ElasticsearchProduct(http.HandlerFunc(GetHealthInfo)).ServeHTTP(rec, httptest.NewRequest("GET", "/_cluster/health", nil))
+
+	assert.Equal(t, "Elasticsearch", rec.Header().Get("X-Elastic-Product"))
+}
+
+func TestProxyClient_DoElasticsearchCompat(t *testing.T) {
+	client := &scriptedHTTPClient{Statuses: []int{http.StatusOK}}
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              client,
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+		ElasticsearchCompat: true,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/_bulk"},
+		Host:   "compat.host",
+		Header: http.Header{
+			"Accept":       []string{"application/vnd.elasticsearch+json; compatible-with=7"},
+			"Content-Type": []string{"application/vnd.elasticsearch+x-ndjson; compatible-with=7"},
+		},
+	})
+
+	assert.NoError(t, err)
+	if assert.Len(t, client.Requests, 1) {
+		assert.Equal(t, "application/json", client.Requests[0].Header.Get("Accept"))
+		assert.Equal(t, "application/x-ndjson", client.Requests[0].Header.Get("Content-Type"))
+	}
+}
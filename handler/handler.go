@@ -16,42 +16,99 @@
 package handler
 
 import (
-	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Handler struct {
 	ProxyClient Client
+	// FlushInterval is how often a streamed response is flushed to the client. Zero relies on
+	// the server buffering, a negative value flushes after every write. Responses of unknown
+	// length and event streams are always flushed after every write.
+	FlushInterval time.Duration
 }
 
-func (h *Handler) write(w http.ResponseWriter, status int, body []byte) {
+// writeProxyError answers a request that could not be proxied.
+func writeProxyError(w http.ResponseWriter, err error) {
+	var tooLarge *BodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		errorMsg := "request entity too large"
+		log.WithError(err).Warn(errorMsg)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		return
+	}
+
+	var unknownRole *UnknownRoleError
+	var roleNotAllowed *RoleNotAllowedError
+	if errors.As(err, &unknownRole) || errors.As(err, &roleNotAllowed) {
+		log.WithError(err).Warn("rejected role")
+		writeOpenSearchError(w, http.StatusForbidden, "security_exception", err.Error())
+		return
+	}
+
+	errorMsg := "unable to proxy request"
+	log.WithError(err).Error(errorMsg)
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write([]byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+}
+
+type errorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type errorDetails struct {
+	RootCause []errorCause `json:"root_cause"`
+	errorCause
+}
+
+type errorResponse struct {
+	Error  errorDetails `json:"error"`
+	Status int          `json:"status"`
+}
+
+// writeOpenSearchError answers with an error in the format of OpenSearch, for clients to report it
+// like any other.
+func writeOpenSearchError(w http.ResponseWriter, status int, errType, reason string) {
+	cause := errorCause{Type: errType, Reason: reason}
+	b, _ := json.Marshal(errorResponse{
+		Error:  errorDetails{RootCause: []errorCause{cause}, errorCause: cause},
+		Status: status,
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(status)
-	w.Write(body)
+	w.Write(b)
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inFlightRequests.Inc()
+	defer inFlightRequests.Dec()
+
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() {
+		responseSize.WithLabelValues(r.Method, requestAPIFamily(r)).Observe(float64(cw.written))
+	}()
+	w = cw
+
 	resp, err := h.ProxyClient.Do(r)
 	if err != nil {
-		errorMsg := "unable to proxy request"
-		log.WithError(err).Error(errorMsg)
-		h.write(w, http.StatusBadGateway, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
+		writeProxyError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	// read response body
-	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		errorMsg := "error while reading response from upstream"
-		log.WithError(err).Error(errorMsg)
-		h.write(w, http.StatusInternalServerError, []byte(fmt.Sprintf("%v - %v", errorMsg, err.Error())))
-		return
-	}
-
 	// copy headers
 	for k, vals := range resp.Header {
 		for _, v := range vals {
@@ -59,5 +116,126 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	h.write(w, resp.StatusCode, buf.Bytes())
+	// announce trailers, their values are only known once the body has been read
+	if len(resp.Trailer) > 0 {
+		trailers := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			trailers = append(trailers, k)
+		}
+		sort.Strings(trailers)
+		w.Header().Add("Trailer", strings.Join(trailers, ", "))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	dst := io.Writer(w)
+	if flusher, ok := w.(http.Flusher); ok {
+		if latency := h.flushInterval(resp); latency != 0 {
+			fw := &flushWriter{dst: w, flusher: flusher, latency: latency}
+			defer fw.stop()
+			dst = fw
+		}
+	}
+
+	readErr, writeErr := copyResponse(dst, resp.Body)
+	if writeErr != nil {
+		log.WithError(writeErr).Debug("client went away while streaming response")
+		return
+	}
+	if readErr != nil {
+		// Headers are gone already, so the only way to signal the failure is to abort the
+		// connection rather than let the client mistake a truncated body for a complete one.
+		log.WithError(readErr).Error("error while reading response from upstream")
+		panic(http.ErrAbortHandler)
+	}
+
+	for k, vals := range resp.Trailer {
+		w.Header()[k] = vals
+	}
+}
+
+func (h *Handler) flushInterval(resp *http.Response) time.Duration {
+	if resp.ContentLength == -1 {
+		return -1
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+
+	return h.FlushInterval
+}
+
+// copyResponse streams src to dst, telling apart errors reading from upstream and writing to the client.
+func copyResponse(dst io.Writer, src io.Reader) (readErr error, writeErr error) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+// flushWriter flushes writes to the client at most latency after they happened,
+// or straight away when latency is negative.
+type flushWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex
+	t            *time.Timer
+	flushPending bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.dst.Write(p)
+	if f.latency < 0 {
+		f.flusher.Flush()
+		return n, err
+	}
+	if f.flushPending {
+		return n, err
+	}
+	if f.t == nil {
+		f.t = time.AfterFunc(f.latency, f.delayedFlush)
+	} else {
+		f.t.Reset(f.latency)
+	}
+	f.flushPending = true
+
+	return n, err
+}
+
+func (f *flushWriter) delayedFlush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.flushPending {
+		return
+	}
+	f.flusher.Flush()
+	f.flushPending = false
+}
+
+func (f *flushWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.flushPending = false
+	if f.t != nil {
+		f.t.Stop()
+	}
 }
@@ -28,6 +28,7 @@ import (
 
 type mockProxyClient struct {
 	Fail     bool
+	Err      error
 	Response *http.Response
 }
 
@@ -35,6 +36,9 @@ func (m *mockProxyClient) Do(req *http.Request) (*http.Response, error) {
 	if m.Fail {
 		return nil, fmt.Errorf("mockProxyClient.Do failed")
 	}
+	if m.Err != nil {
+		return nil, m.Err
+	}
 
 	return m.Response, nil
 }
@@ -63,6 +67,18 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				header:     http.Header{},
 			},
 		},
+		{
+			name: "responds with 413 if request body is too large",
+			handler: &Handler{
+				ProxyClient: &mockProxyClient{Err: &BodyTooLargeError{Limit: 10}},
+			},
+			request: &http.Request{},
+			want: &want{
+				statusCode: http.StatusRequestEntityTooLarge,
+				body:       []byte(`request entity too large - request body exceeds maximum size of 10 bytes`),
+				header:     http.Header{},
+			},
+		},
 		{
 			name: "responds with proxied response if everything is 👍",
 			handler: &Handler{
@@ -104,3 +120,94 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+// flushRecorder signals every flush so tests can observe the response while it is being streamed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+}
+
+func (f *flushRecorder) Flush() {
+	f.ResponseRecorder.Flush()
+	f.flushed <- struct{}{}
+}
+
+func TestHandler_ServeHTTPStreamsResponse(t *testing.T) {
+	pr, pw := io.Pipe()
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": []string{"application/json"}},
+				ContentLength: -1,
+				Body:          pr,
+			},
+		},
+	}
+	r := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(r, &http.Request{})
+		close(done)
+	}()
+
+	pw.Write([]byte(`{"hits":`))
+	<-r.flushed
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "application/json", r.Header().Get("Content-Type"))
+	assert.Equal(t, `{"hits":`, r.Body.String())
+
+	pw.Write([]byte(`[]}`))
+	<-r.flushed
+	pw.Close()
+	<-done
+
+	assert.Equal(t, `{"hits":[]}`, r.Body.String())
+}
+
+func TestHandler_ServeHTTPForwardsTrailers(t *testing.T) {
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Trailer:    http.Header{"X-Checksum": []string{"abc"}},
+				Body:       io.NopCloser(bytes.NewBufferString(`streamed`)),
+			},
+		},
+	}
+	r := httptest.NewRecorder()
+
+	h.ServeHTTP(r, &http.Request{})
+
+	response := r.Result()
+	responseBody, _ := io.ReadAll(response.Body)
+	assert.Equal(t, []byte(`streamed`), responseBody)
+	assert.Equal(t, "abc", response.Trailer.Get("X-Checksum"))
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("upstream connection reset")
+}
+
+func TestHandler_ServeHTTPAbortsOnUpstreamError(t *testing.T) {
+	h := &Handler{
+		ProxyClient: &mockProxyClient{
+			Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(io.MultiReader(bytes.NewBufferString(`partial`), failingReader{})),
+			},
+		},
+	}
+	r := httptest.NewRecorder()
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(r, &http.Request{})
+	})
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, `partial`, r.Body.String())
+}
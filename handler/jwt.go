@@ -0,0 +1,333 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksMissInterval is how often a JWKS URL is fetched again for a token signed with an unknown key.
+	jwksMissInterval = time.Minute
+	// jwksRetryInterval is how long a JWKS URL is not fetched again after it failed.
+	jwksRetryInterval = 10 * time.Second
+	// jwksFetchTimeout bounds the fetches of a JWKS URL made on the request path.
+	jwksFetchTimeout = 10 * time.Second
+
+	maxJWKSSize = 1 << 20
+)
+
+// jwtMethods are the asymmetric algorithms accepted, symmetric ones would let JWKS keys sign tokens.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWKS holds the public keys of a JSON Web Key Set, read from File or fetched from URL. Keys fetched
+// from URL are fetched again every RefreshInterval, and when a token is signed with an unknown key.
+type JWKS struct {
+	File            string
+	URL             string
+	RefreshInterval time.Duration
+	Client          *http.Client
+
+	mu         sync.Mutex
+	keys       map[string]interface{}
+	fetched    time.Time
+	failed     time.Time
+	refreshing bool
+}
+
+// Load reads or fetches the keys.
+func (j *JWKS) Load(ctx context.Context) error {
+	var b []byte
+	var err error
+	if j.URL != "" {
+		b, err = j.fetch(ctx)
+	} else {
+		b, err = os.ReadFile(j.File)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.fetched = time.Now()
+	j.mu.Unlock()
+
+	return nil
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := j.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS %s answered %d", j.URL, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// key returns the key of ID kid, the only key when kid is empty.
+func (j *JWKS) key(kid string) (interface{}, error) {
+	keys, refresh := j.keysToRefresh(kid)
+	if refresh {
+		// Fetched apart from the request, a client going away is not a failure of the URL
+		fetchCtx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+		err := j.Load(fetchCtx)
+		cancel()
+
+		j.mu.Lock()
+		j.refreshing = false
+		if err != nil {
+			j.failed = time.Now()
+		}
+		keys = j.keys
+		j.mu.Unlock()
+
+		if err != nil {
+			log.WithError(err).WithField("url", j.URL).Warn("unable to refresh JWKS, using the keys fetched before")
+		}
+	}
+
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+// keysToRefresh returns the keys, and whether the caller must refresh them for kid. Only one caller
+// refreshes at a time, the others use the keys fetched before, and none does after a recent failure.
+func (j *JWKS) keysToRefresh(kid string) (map[string]interface{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.URL == "" || j.refreshing || time.Since(j.failed) < jwksRetryInterval {
+		return j.keys, false
+	}
+	_, known := j.keys[kid]
+	stale := j.RefreshInterval > 0 && time.Since(j.fetched) > j.RefreshInterval
+	if !stale && (known || time.Since(j.fetched) < jwksMissInterval) {
+		return j.keys, false
+	}
+	j.refreshing = true
+
+	return j.keys, true
+}
+
+// jwk is a public key of a JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the RSA and EC signing keys of a JSON Web Key Set by ID, other keys are ignored.
+func parseJWKS(b []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsa()
+		case "EC":
+			key, err = k.ecdsa()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid JWKS: no RSA or EC signing keys")
+	}
+
+	return keys, nil
+}
+
+func (k jwk) rsa() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid RSA modulus or exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (k jwk) ecdsa() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+	}
+
+	return key, nil
+}
+
+// JWTAuthenticator authenticates clients sending Authorization: Bearer with a JWT signed by one of
+// the keys of Keys, unexpired and, when set, of Issuer and for Audience.
+type JWTAuthenticator struct {
+	Keys     *JWKS
+	Issuer   string
+	Audience string
+	// PrincipalClaim names the client, sub when empty.
+	PrincipalClaim string
+	// GroupsClaim lists the groups of the client, a string or an array of strings, none when empty.
+	GroupsClaim string
+}
+
+func (j *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw, ok := authorization(r, "Bearer")
+	if !ok {
+		return nil, errNoCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(jwt.WithValidMethods(jwtMethods)).ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return j.Keys.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if j.Issuer != "" && !claims.VerifyIssuer(j.Issuer, true) {
+		return nil, fmt.Errorf("token issuer is not %s", j.Issuer)
+	}
+	if j.Audience != "" && !claims.VerifyAudience(j.Audience, true) {
+		return nil, fmt.Errorf("token audience is not %s", j.Audience)
+	}
+
+	claim := j.PrincipalClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	name, _ := claims[claim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("token has no %s claim", claim)
+	}
+
+	return &Principal{Name: name, Method: "jwt", Groups: claimStrings(claims[j.GroupsClaim])}, nil
+}
+
+func (j *JWTAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// claimStrings returns a claim holding a string or an array of strings as a slice.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	set, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}})
+	keys := &JWKS{File: writeTempFile(t, "jwks.json", string(set))}
+	assert.NoError(t, keys.Load(context.Background()))
+
+	auth := &JWTAuthenticator{Keys: keys, Issuer: "https://idp.example.com", Audience: "search", GroupsClaim: "groups"}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := jwt.MapClaims{"sub": "alice", "iss": "https://idp.example.com", "aud": "search", "exp": exp, "groups": []string{"logs-readers"}}
+
+	tests := []struct {
+		name  string
+		token string
+		want  *Principal
+		err   string
+	}{
+		{
+			name:  "should accept tokens signed with RSA keys",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa", rsaKey, valid),
+			want:  &Principal{Name: "alice", Method: "jwt", Groups: []string{"logs-readers"}},
+		},
+		{
+			name:  "should accept tokens signed with EC keys",
+			token: signJWT(t, jwt.SigningMethodES256, "ec", ecKey, valid),
+			want:  &Principal{Name: "alice", Method: "jwt", Groups: []string{"logs-readers"}},
+		},
+		{
+			name:  "should reject tokens signed with other keys",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa", otherKey, valid),
+			err:   "crypto/rsa: verification error",
+		},
+		{
+			name:  "should reject tokens signed with unknown keys",
+			token: signJWT(t, jwt.SigningMethodRS256, "other", otherKey, valid),
+			err:   `unknown signing key "other"`,
+		},
+		{
+			name:  "should reject symmetric algorithms",
+			token: signJWT(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), valid),
+			err:   "signing method HS256 is invalid",
+		},
+		{
+			name:  "should reject expired tokens",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{"sub": "alice", "iss": "https://idp.example.com", "aud": "search", "exp": time.Now().Add(-time.Minute).Unix()}),
+			err:   "Token is expired",
+		},
+		{
+			name:  "should reject tokens without expiry",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{"sub": "alice", "iss": "https://idp.example.com", "aud": "search"}),
+			err:   "token has no expiry",
+		},
+		{
+			name:  "should reject tokens for other audiences",
+			token: signJWT(t, jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{"sub": "alice", "iss": "https://idp.example.com", "aud": "billing", "exp": exp}),
+			err:   "token audience is not search",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			principal, err := auth.Authenticate(req)
+
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, principal)
+		})
+	}
+}
+
+func TestJWKS_keyFetchesUnknownKeys(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	jwks := []interface{}{rsaJWK("first", &first.PublicKey)}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+	}))
+	defer server.Close()
+
+	keys := &JWKS{URL: server.URL, RefreshInterval: time.Hour}
+	assert.NoError(t, keys.Load(context.Background()))
+
+	// The key was rotated since the keys were fetched
+	jwks = append(jwks, rsaJWK("second", &second.PublicKey))
+	keys.fetched = time.Now().Add(-2 * jwksMissInterval)
+
+	key, err := keys.key("second")
+	assert.NoError(t, err)
+	assert.Equal(t, &second.PublicKey, key)
+	assert.Equal(t, 2, fetches)
+
+	// Unknown keys are not fetched again right away
+	_, err = keys.key("third")
+	assert.ErrorContains(t, err, `unknown signing key "third"`)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJWKS_keyBacksOffFailures(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	keys := &JWKS{
+		URL:     server.URL,
+		keys:    map[string]interface{}{"first": &key.PublicKey},
+		fetched: time.Now().Add(-2 * jwksMissInterval),
+	}
+
+	// Concurrent requests for an unknown key fetch the URL once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.key("second")
+			assert.ErrorContains(t, err, `unknown signing key "second"`)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches == 1
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// The URL is not fetched again right after it failed
+	_, err = keys.key("second")
+	assert.ErrorContains(t, err, `unknown signing key "second"`)
+	got, err := keys.key("first")
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, got)
+	assert.Equal(t, 1, fetches)
+
+	keys.failed = time.Now().Add(-jwksRetryInterval)
+	_, err = keys.key("second")
+	assert.ErrorContains(t, err, `unknown signing key "second"`)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestJWTAuthenticator_AuthenticateCanceledRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{rsaJWK("rotated", &key.PublicKey)}})
+	}))
+	defer server.Close()
+
+	keys := &JWKS{URL: server.URL, keys: map[string]interface{}{}, fetched: time.Now().Add(-2 * jwksMissInterval)}
+	auth := &JWTAuthenticator{Keys: keys}
+
+	// A client going away does not fail the refresh of the keys
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, jwt.SigningMethodRS256, "rotated", key, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}))
+
+	principal, err := auth.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", principal.Name)
+	assert.True(t, keys.failed.IsZero())
+}
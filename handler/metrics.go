@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "aws_sigv4_proxy"
+
+	// apiIntercepted labels requests answered by the proxy without contacting upstream.
+	apiIntercepted = "intercepted"
+	// apiProbe labels the requests probing upstream for readiness checks and cluster health.
+	apiProbe = "probe"
+
+	// upstreamOther labels requests sent to the Host of the client, which is not a bounded set of values.
+	upstreamOther = "other"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests handled, by upstream host, signing service, method, API family and status code.",
+	}, []string{"upstream", "service", "method", "api", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time until response headers were received, by upstream host, signing service, method and API family.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream", "service", "method", "api"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream attempts retried, by upstream host, signing service, API family and the status code or error retried on.",
+	}, []string{"upstream", "service", "api", "reason"})
+
+	bulkItemRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bulk_item_retries_total",
+		Help:      "Items of _bulk requests sent again, by the item status retried on.",
+	}, []string{"reason"})
+
+	signingFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signing_failures_total",
+		Help:      "Requests that could not be signed, by upstream host and signing service.",
+	}, []string{"upstream", "service"})
+
+	credentialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "credential_refresh_failures_total",
+		Help:      "Failures to retrieve credentials for signing, by upstream host and signing service.",
+	}, []string{"upstream", "service"})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "in_flight_requests",
+		Help:      "Requests currently being served.",
+	})
+
+	requestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_size_bytes",
+		Help:      "Size of proxied request bodies, by method and API family.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 12),
+	}, []string{"method", "api"})
+
+	responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_size_bytes",
+		Help:      "Size of response bodies sent to clients, by method and API family.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 12),
+	}, []string{"method", "api"})
+)
+
+// apiFamilies are the OpenSearch APIs worth telling apart, anything else is reported as other.
+var apiFamilies = map[string]bool{
+	"_aliases":         true,
+	"_alias":           true,
+	"_bulk":            true,
+	"_cat":             true,
+	"_cluster":         true,
+	"_count":           true,
+	"_create":          true,
+	"_delete_by_query": true,
+	"_doc":             true,
+	"_field_caps":      true,
+	"_mapping":         true,
+	"_mget":            true,
+	"_msearch":         true,
+	"_nodes":           true,
+	"_plugins":         true,
+	"_refresh":         true,
+	"_search":          true,
+	"_settings":        true,
+	"_stats":           true,
+	"_update":          true,
+	"_update_by_query": true,
+}
+
+// apiFamily classifies a request path by its first underscore prefixed segment, keeping label
+// cardinality bounded regardless of index names and document IDs.
+func apiFamily(path string) string {
+	for _, segment := range strings.Split(path, "/") {
+		if !strings.HasPrefix(segment, "_") {
+			continue
+		}
+		if apiFamilies[segment] {
+			return segment
+		}
+		return "other"
+	}
+
+	if strings.Trim(path, "/") == "" {
+		return "root"
+	}
+
+	return "index"
+}
+
+func requestAPIFamily(r *http.Request) string {
+	if r.URL == nil {
+		return apiFamily("")
+	}
+
+	return apiFamily(r.URL.Path)
+}
+
+// upstreamLabel is the upstream of the metrics of p, HostOverride or upstreamOther.
+func (p *ProxyClient) upstreamLabel() string {
+	if p.HostOverride == "" {
+		return upstreamOther
+	}
+	return p.HostOverride
+}
+
+// observeRequest records a completed request, status is the response status code or zero on failure.
+func observeRequest(upstream, service, method, api string, status int, start time.Time) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+
+	requestsTotal.WithLabelValues(upstream, service, method, api, code).Inc()
+	requestDuration.WithLabelValues(upstream, service, method, api).Observe(time.Since(start).Seconds())
+}
+
+// countingWriter counts the bytes written to a client.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// InstrumentIntercepted records metrics for endpoints answered by the proxy itself. It is meant to
+// be used as a mux middleware, which gorilla/mux only applies to matched routes.
+func InstrumentIntercepted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlightRequests.Inc()
+		defer inFlightRequests.Dec()
+
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+
+		observeRequest("", "", r.Method, apiIntercepted, cw.status, start)
+		responseSize.WithLabelValues(r.Method, apiIntercepted).Observe(float64(cw.written))
+	})
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiFamily(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/", want: "root"},
+		{path: "", want: "root"},
+		{path: "/logs", want: "index"},
+		{path: "/logs/_search", want: "_search"},
+		{path: "/_bulk", want: "_bulk"},
+		{path: "/logs/_doc/1", want: "_doc"},
+		{path: "/_search/scroll", want: "_search"},
+		{path: "/logs/_rank_eval", want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, apiFamily(tt.path))
+		})
+	}
+}
+
+func TestProxyClient_DoMetrics(t *testing.T) {
+	newRequest := func() *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/logs/_search"},
+			Host:   "metrics.host",
+		}
+	}
+
+	// Without HostOverride the Host of the client is not used as a label
+	requests := requestsTotal.WithLabelValues(upstreamOther, "aoss", "GET", "_search", "error")
+	credentialErrors := credentialFailures.WithLabelValues(upstreamOther, "aoss")
+	before, beforeCredentialErrors := testutil.ToFloat64(requests), testutil.ToFloat64(credentialErrors)
+
+	failing := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{Fail: true})),
+		Client:              &mockHTTPClient{},
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+	}
+	_, err := failing.Do(newRequest())
+	assert.Error(t, err)
+
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+	assert.Equal(t, beforeCredentialErrors+1, testutil.ToFloat64(credentialErrors))
+
+	succeeded := requestsTotal.WithLabelValues("override.host", "aoss", "GET", "_search", "200")
+	before = testutil.ToFloat64(succeeded)
+	working := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              &bodyReadingHTTPClient{},
+		HostOverride:        "override.host",
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+	}
+	_, err = working.Do(newRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(succeeded))
+}
+
+func TestInstrumentIntercepted(t *testing.T) {
+	requests := requestsTotal.WithLabelValues("", "", "GET", apiIntercepted, "200")
+	before := testutil.ToFloat64(requests)
+
+	h := InstrumentIntercepted(http.HandlerFunc(GetInfo))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+}
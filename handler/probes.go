@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LivenessPath answers whether the proxy is running.
+	LivenessPath = "/_proxy/healthz"
+	// ReadinessPath answers whether the proxy is ready to serve traffic.
+	ReadinessPath = "/_proxy/readyz"
+
+	// DefaultProbeTimeout bounds the readiness checks when Probes has no Timeout.
+	DefaultProbeTimeout = 5 * time.Second
+
+	// upstreamCheckTTL is how long the outcome of a probe of upstream is reused for.
+	upstreamCheckTTL = 10 * time.Second
+)
+
+// ReadinessCheck is a condition the proxy must meet to be ready, such as being able to retrieve credentials.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Probes serves the endpoints reporting on the proxy itself, ahead of the routes of every listener.
+type Probes struct {
+	// Timeout bounds the time given to all readiness checks together.
+	Timeout time.Duration
+
+	shuttingDown int32
+	checks       atomic.Value
+}
+
+// ShutDown makes readiness fail from now on, for load balancers to stop sending traffic.
+func (p *Probes) ShutDown() {
+	atomic.StoreInt32(&p.shuttingDown, 1)
+}
+
+// SetChecks atomically replaces the readiness checks.
+func (p *Probes) SetChecks(checks []ReadinessCheck) {
+	p.checks.Store(checks)
+}
+
+// Handler serves the probe endpoints and hands every other request to next.
+func (p *Probes) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			switch r.URL.Path {
+			case LivenessPath:
+				writeProbe(w, http.StatusOK, probeResult{Status: "ok"})
+				return
+			case ReadinessPath:
+				p.ready(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type probeResult struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (p *Probes) ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&p.shuttingDown) != 0 {
+		writeProbe(w, http.StatusServiceUnavailable, probeResult{Status: "shutting down"})
+		return
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	checks, _ := p.checks.Load().([]ReadinessCheck)
+	results := make([]checkResult, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check ReadinessCheck) {
+			defer wg.Done()
+
+			results[i] = checkResult{Name: check.Name, Status: "ok"}
+			if err := check.Check(ctx); err != nil {
+				results[i].Status, results[i].Error = "fail", err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	status, result := http.StatusOK, probeResult{Status: "ready", Checks: results}
+	for _, check := range results {
+		if check.Status != "ok" {
+			log.WithField("check", check.Name).WithField("error", check.Error).Warn("readiness check failed")
+			status, result.Status = http.StatusServiceUnavailable, "unready"
+		}
+	}
+
+	writeProbe(w, status, result)
+}
+
+func writeProbe(w http.ResponseWriter, status int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// CheckCredentials retrieves the credentials requests are signed with, from the provider chain or
+// by assuming the configured roles.
+func (p *ProxyClient) CheckCredentials(ctx context.Context) error {
+	if _, err := p.Signer.Credentials.GetWithContext(ctx); err != nil {
+		return err
+	}
+	for _, role := range p.Roles {
+		if _, err := role.Signer.Credentials.GetWithContext(ctx); err != nil {
+			return fmt.Errorf("role %s: %w", role.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// probeKey marks the contexts of the requests probing upstream.
+type probeKey struct{}
+
+// withProbe returns a copy of ctx whose requests probe upstream, they are labeled apart in metrics
+// and not traced.
+func withProbe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeKey{}, true)
+}
+
+func isProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(probeKey{}).(bool)
+	return probe
+}
+
+// upstreamCheck is a probe of a path of a host.
+type upstreamCheck struct {
+	host string
+	path string
+}
+
+// CheckUpstream makes a signed request for path to host, or to HostOverride when set. Any answer
+// but an authentication failure or a server error shows upstream is reachable and accepts the signature.
+// The outcome is reused for upstreamCheckTTL, so that frequent probes do not all reach upstream.
+func (p *ProxyClient) CheckUpstream(ctx context.Context, host, path string) error {
+	checked, err := p.upstreamChecks.get(ctx, upstreamCheck{host: host, path: path}, upstreamCheckTTL, func() (error, error) {
+		ctx, cancel := context.WithTimeout(withProbe(context.Background()), DefaultProbeTimeout)
+		defer cancel()
+		return p.checkUpstream(ctx, host, path), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return checked
+}
+
+func (p *ProxyClient) checkUpstream(ctx context.Context, host, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+
+	resp, err := p.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if p.HostOverride != "" {
+		host = p.HostOverride
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream %s answered %d", host, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProbes_Handler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name         string
+		shuttingDown bool
+		checks       []ReadinessCheck
+		method       string
+		target       string
+		wantStatus   int
+		wantBody     string
+	}{
+		{
+			name:       "should report ready",
+			method:     "GET",
+			target:     ReadinessPath,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"ready"}` + "\n",
+		},
+		{
+			name: "should report passing checks",
+			checks: []ReadinessCheck{
+				{Name: "credentials/logs", Check: func(ctx context.Context) error { return nil }},
+			},
+			method:     "GET",
+			target:     ReadinessPath,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"ready","checks":[{"name":"credentials/logs","status":"ok"}]}` + "\n",
+		},
+		{
+			name: "should name failing checks",
+			checks: []ReadinessCheck{
+				{Name: "credentials/logs", Check: func(ctx context.Context) error { return nil }},
+				{Name: "upstream/logs", Check: func(ctx context.Context) error { return fmt.Errorf("upstream answered 403") }},
+			},
+			method:     "GET",
+			target:     ReadinessPath,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"status":"unready","checks":[{"name":"credentials/logs","status":"ok"},{"name":"upstream/logs","status":"fail","error":"upstream answered 403"}]}` + "\n",
+		},
+		{
+			name:         "should report liveness when shutting down",
+			shuttingDown: true,
+			method:       "GET",
+			target:       LivenessPath,
+			wantStatus:   http.StatusOK,
+			wantBody:     `{"status":"ok"}` + "\n",
+		},
+		{
+			name:         "should fail readiness when shutting down",
+			shuttingDown: true,
+			method:       "GET",
+			target:       ReadinessPath,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantBody:     `{"status":"shutting down"}` + "\n",
+		},
+		{
+			name:       "should hand other requests to next",
+			method:     "GET",
+			target:     "/_proxy/readyz/more",
+			wantStatus: http.StatusTeapot,
+		},
+		{
+			name:       "should hand other methods to next",
+			method:     "POST",
+			target:     ReadinessPath,
+			wantStatus: http.StatusTeapot,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probes := &Probes{}
+			probes.SetChecks(tt.checks)
+			if tt.shuttingDown {
+				probes.ShutDown()
+			}
+
+			rec := httptest.NewRecorder()
+			probes.Handler(next).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantBody, rec.Body.String())
+		})
+	}
+}
+
+func TestProxyClient_CheckUpstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+	}{
+		{name: "should accept a successful answer", status: http.StatusOK},
+		{name: "should accept a missing path", status: http.StatusNotFound},
+		{name: "should reject a denied signature", status: http.StatusForbidden, err: fmt.Errorf("upstream probe.host answered 403")},
+		{name: "should reject server errors", status: http.StatusServiceUnavailable, err: fmt.Errorf("upstream probe.host answered 503")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scriptedHTTPClient{Statuses: []int{tt.status}}
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:              client,
+				SigningNameOverride: "aoss",
+				RegionOverride:      "us-west-2",
+				HostOverride:        "probe.host",
+			}
+
+			err := proxyClient.CheckUpstream(context.Background(), "", "/")
+
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err.Error())
+			}
+			if assert.Len(t, client.Requests, 1) {
+				assert.Equal(t, "https://probe.host/", client.Requests[0].URL.String())
+				assert.Contains(t, client.Requests[0].Header.Get("Authorization"), "AWS4-HMAC-SHA256")
+			}
+		})
+	}
+}
+
+func TestProxyClient_CheckUpstreamCaches(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	client := &scriptedHTTPClient{Statuses: []int{http.StatusOK, http.StatusOK}}
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              client,
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+		HostOverride:        "cached.probe.host",
+		Tracer:              tp.Tracer("test"),
+	}
+	probes := requestsTotal.WithLabelValues("cached.probe.host", "aoss", "GET", apiProbe, "200")
+	before := testutil.ToFloat64(probes)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, proxyClient.CheckUpstream(context.Background(), "", "/"))
+	}
+
+	// Probes reach upstream once per upstreamCheckTTL, labeled apart and untraced
+	assert.Len(t, client.Requests, 1)
+	assert.Equal(t, before+1, testutil.ToFloat64(probes))
+	assert.Empty(t, exporter.GetSpans())
+}
@@ -17,17 +17,23 @@ package handler
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
-	"github.com/minio/sha256-simd"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Client is an interface to make testing http.Client calls easier
@@ -44,48 +50,58 @@ type ProxyClient struct {
 	HostOverride        string
 	RegionOverride      string
 	LogFailedRequest    bool
+	// MaxBodySize is the largest request body accepted, zero disables the limit.
+	MaxBodySize int64
+	// MemoryBufferSize is how much of a request body is held in memory before it is spilled to TempDir.
+	MemoryBufferSize int64
+	// TempDir is where large request bodies are spooled, the OS default is used when empty.
+	TempDir string
+	// Retry decides which failed attempts are sent again, requests are attempted once when nil.
+	Retry *RetryPolicy
+	// Tracer creates the spans of proxied requests, the global tracer provider is used when nil.
+	Tracer trace.Tracer
+	// ElasticsearchCompat rewrites the Elasticsearch vendor media types sent by Elasticsearch
+	// clients to the plain ones upstream accepts.
+	ElasticsearchCompat bool
+	// QueryRules drop or rewrite the query parameters upstream does not support.
+	QueryRules []QueryRule
+	// Roles sign the requests of the clients mapped to them, or that select them through the trusted
+	// role header, instead of Signer.
+	Roles []RoleSigner
+
+	upstreamChecks ttlCache[upstreamCheck, error]
 }
 
-func (p *ProxyClient) sign(req *http.Request, service *endpoints.ResolvedEndpoint) error {
-	body := bytes.NewReader([]byte{})
-
-	if req.Body != nil {
-		b, err := io.ReadAll(req.Body)
-		if err != nil {
-			return err
-		}
+const (
+	// maxLoggedBodySize caps how much of a request body is logged for failed requests.
+	maxLoggedBodySize = 64 << 10
+)
 
-		body = bytes.NewReader(b)
-	}
+func (p *ProxyClient) sign(signer *v4.Signer, req *http.Request, body *spool, service *endpoints.ResolvedEndpoint) error {
 
 	// S3 service should not have any escaping applied.
 	// https://github.com/aws/aws-sdk-go/blob/main/aws/signer/v4/v4.go#L467-L470
 	if service.SigningName == "s3" {
-		p.Signer.DisableURIPathEscaping = true
+		signer.DisableURIPathEscaping = true
 
 		// Enable URI escaping for subsequent calls.
 		defer func() {
-			p.Signer.DisableURIPathEscaping = false
+			signer.DisableURIPathEscaping = false
 		}()
 	}
 
 	if service.SigningName == "aoss" {
-		// Pre-compute the SHA-256 hash of the body
-
-		hash, err := hexEncodedSha256OfRequest(req)
-		req.Header.Set("X-Amz-Content-Sha256", hash)
-		if err != nil {
-			return err
-		}
+		// The SHA-256 hash of the body was computed while spooling it
+		req.Header.Set("X-Amz-Content-Sha256", body.Sum())
 	}
 
 	var err error
 	switch service.SigningMethod {
 	case "v4", "s3v4":
-		_, err = p.Signer.Sign(req, body, service.SigningName, service.SigningRegion, time.Now())
+		_, err = signer.Sign(req, body.NewReader(), service.SigningName, service.SigningRegion, time.Now())
 		break
 	case "s3":
-		_, err = p.Signer.Presign(req, body, service.SigningName, service.SigningRegion, time.Hour, time.Now())
+		_, err = signer.Presign(req, body.NewReader(), service.SigningName, service.SigningRegion, time.Hour, time.Now())
 		break
 	default:
 		err = fmt.Errorf("unable to sign with specified signing method %s for service %s", service.SigningMethod, service.SigningName)
@@ -109,7 +125,21 @@ func copyHeaderWithoutOverwrite(dst, src http.Header) {
 	}
 }
 
-func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
+func dumpRequest(msg string, req *http.Request, body *spool) {
+	dump, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		log.WithError(err).Error("unable to dump request")
+	}
+
+	// Bodies spilled to disk are too large to be worth logging
+	if body != nil && !body.OnDisk() {
+		b, _ := io.ReadAll(body.NewReader())
+		dump = append(dump, b...)
+	}
+	log.WithField("request", string(dump)).Debug(msg)
+}
+
+func (p *ProxyClient) Do(req *http.Request) (resp *http.Response, err error) {
 	proxyURL := *req.URL
 	if p.HostOverride != "" {
 		proxyURL.Host = p.HostOverride
@@ -119,23 +149,76 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 	}
 	proxyURL.Scheme = "https"
 
-	if log.GetLevel() == log.DebugLevel {
-		initialReqDump, err := httputil.DumpRequest(req, true)
-		if err != nil {
-			log.WithError(err).Error("unable to dump request")
+	start := time.Now()
+	api := requestAPIFamily(req)
+	if isProbe(req.Context()) {
+		api = apiProbe
+	}
+	var service *endpoints.ResolvedEndpoint
+
+	// Continue the trace of the incoming request, if any.
+	ctx := traceContext.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := p.tracer(ctx).Start(ctx, "proxy "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.NetPeerNameKey.String(proxyURL.Host),
+			attribute.String("opensearch.api", api),
+		),
+	)
+
+	defer func() {
+		signingName := ""
+		if service != nil {
+			signingName = service.SigningName
+			span.SetAttributes(attribute.String("aws.signing_name", service.SigningName), attribute.String("aws.region", service.SigningRegion))
+		}
+
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
 		}
-		log.WithField("request", string(initialReqDump)).Debug("Initial request dump:")
+
+		endSpan(span, err)
+		observeRequest(p.upstreamLabel(), signingName, req.Method, api, status, start)
+	}()
+
+	if p.MaxBodySize > 0 && req.ContentLength > p.MaxBodySize {
+		return nil, &BodyTooLargeError{Limit: p.MaxBodySize}
 	}
 
-	proxyReq, err := http.NewRequest(req.Method, proxyURL.String(), req.Body)
+	signer, err := p.signer(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if req.ContentLength >= 0 {
-		proxyReq.ContentLength = req.ContentLength
+
+	// Hash the body while spooling it so that it is read from the client only once and
+	// can be replayed for signing and sending without being held in memory twice.
+	_, hashSpan := p.tracer(ctx).Start(ctx, "hash body")
+	body, err := spoolBody(req.Body, p.MemoryBufferSize, p.MaxBodySize, p.TempDir)
+	endSpan(hashSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	hashSpan.SetAttributes(attribute.Int64("http.request_content_length", body.Size()))
+	requestSize.WithLabelValues(req.Method, api).Observe(float64(body.Size()))
+
+	// Release the spool once the upstream response is consumed, or straight away on failure.
+	keepBody := false
+	defer func() {
+		if !keepBody {
+			body.Close()
+		}
+	}()
+
+	if log.GetLevel() == log.DebugLevel {
+		dumpRequest("Initial request dump:", req, body)
 	}
 
-	var service *endpoints.ResolvedEndpoint
 	if p.SigningNameOverride != "" && p.RegionOverride != "" {
 		service = &endpoints.ResolvedEndpoint{URL: fmt.Sprintf("https://%s", proxyURL.Host), SigningMethod: "v4", SigningRegion: p.RegionOverride, SigningName: p.SigningNameOverride}
 	} else {
@@ -145,43 +228,60 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 		return nil, fmt.Errorf("unable to determine service from host: %s", req.Host)
 	}
 
-	if err := p.sign(proxyReq, service); err != nil {
-		return nil, err
-	}
-
-	// When ContentLength is 0 we also need to set the body to http.NoBody to avoid Go http client
-	// to magically set Transfer-Encoding: chunked. Service like S3 does not support chunk encoding.
-	// We need to manipulate the Body value after signv4 signing because the signing process wraps
-	// the original body into another struct, which will result in Transfer-Encoding: chunked being set.
-	if proxyReq.ContentLength == 0 {
-		proxyReq.Body = http.NoBody
-	}
-
 	// Remove any headers specified
 	for _, header := range p.StripRequestHeaders {
 		log.WithField("StripHeader", header).Debug("Stripping Header:")
 		req.Header.Del(header)
 	}
 
-	// Add origin headers after request is signed (no overwrite)
-	copyHeaderWithoutOverwrite(proxyReq.Header, req.Header)
+	if p.ElasticsearchCompat {
+		rewriteElasticMediaTypes(req.Header)
+	}
 
-	if log.GetLevel() == log.DebugLevel {
-		proxyReqDump, err := httputil.DumpRequest(proxyReq, true)
+	applyQueryRules(p.QueryRules, req.Method, &proxyURL)
+
+	var proxyReq *http.Request
+	for attempt := 1; ; attempt++ {
+		// Every attempt is signed again so that its signature carries a fresh timestamp.
+		proxyReq, err = p.newSignedRequest(ctx, signer, req, &proxyURL, body, service)
 		if err != nil {
-			log.WithError(err).Error("unable to dump request")
+			return nil, err
 		}
-		log.WithField("request", string(proxyReqDump)).Debug("proxying request")
-	}
 
-	resp, err := p.Client.Do(proxyReq)
+		resp, err = p.send(ctx, proxyReq, body, attempt)
+
+		wait, retry := p.Retry.next(attempt, req.Method, api, resp, err)
+		if !retry {
+			break
+		}
+
+		reason := "error"
+		entry := log.WithField("request", fmt.Sprintf("%s %s", proxyReq.Method, proxyReq.URL)).
+			WithField("attempt", attempt).
+			WithField("backoff", wait)
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			reason = strconv.Itoa(resp.StatusCode)
+			entry = entry.WithField("status_code", resp.StatusCode)
+			// Drain the failed response so its connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		entry.Warn("retrying upstream request")
+		upstreamRetries.WithLabelValues(p.upstreamLabel(), service.SigningName, api, reason).Inc()
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	if (p.LogFailedRequest || log.GetLevel() == log.DebugLevel) && resp.StatusCode >= 400 {
 		b, _ := io.ReadAll(resp.Body)
-		rb, _ := io.ReadAll(proxyReq.Body)
+		rb, _ := io.ReadAll(io.LimitReader(body.NewReader(), maxLoggedBodySize))
 		log.WithField("request", fmt.Sprintf("%s %s", proxyReq.Method, proxyReq.URL)).
 			WithField("request_body", string(rb)).
 			WithField("status_code", resp.StatusCode).
@@ -193,31 +293,80 @@ func (p *ProxyClient) Do(req *http.Request) (*http.Response, error) {
 		resp.Body = io.NopCloser(bytes.NewBuffer(b))
 	}
 
+	// A body spilled to disk must outlive the round trip until the caller is done with the response.
+	if body.OnDisk() && resp.Body != nil {
+		keepBody = true
+		resp.Body = &cleanupReadCloser{ReadCloser: resp.Body, cleanup: body.Close}
+	}
+
 	return resp, nil
 }
 
-const (
-	emptyStringSHA256 = `e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`
-)
+// newSignedRequest builds the upstream request for req, with its body replayed from the spool.
+func (p *ProxyClient) newSignedRequest(ctx context.Context, signer *v4.Signer, req *http.Request, proxyURL *url.URL, body *spool, service *endpoints.ResolvedEndpoint) (*http.Request, error) {
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, proxyURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.ContentLength = body.Size()
 
-func hexEncodedSha256OfRequest(r *http.Request) (string, error) {
-	if r.Body == nil {
-		return emptyStringSHA256, nil
+	// Retrieve credentials ahead of signing to tell credential failures apart from signing ones.
+	credsCtx, credsSpan := p.tracer(ctx).Start(ctx, "retrieve credentials")
+	_, err = signer.Credentials.GetWithContext(credsCtx)
+	endSpan(credsSpan, err)
+	if err != nil {
+		credentialFailures.WithLabelValues(p.upstreamLabel(), service.SigningName).Inc()
+		return nil, err
 	}
 
-	hasher := sha256.New()
-	reqBodyBytes, err := io.ReadAll(r.Body)
+	_, signSpan := p.tracer(ctx).Start(ctx, "sign")
+	err = p.sign(signer, proxyReq, body, service)
+	endSpan(signSpan, err)
 	if err != nil {
-		return "", err
+		signingFailures.WithLabelValues(p.upstreamLabel(), service.SigningName).Inc()
+		return nil, err
 	}
 
-	if err := r.Body.Close(); err != nil {
-		return "", err
+	// When ContentLength is 0 we also need to set the body to http.NoBody to avoid Go http client
+	// to magically set Transfer-Encoding: chunked. Service like S3 does not support chunk encoding.
+	// We need to manipulate the Body value after signv4 signing because the signing process wraps
+	// the original body into another struct, which will result in Transfer-Encoding: chunked being set.
+	// Other bodies are set from the spool as well, presigning leaves the body of the request alone.
+	if proxyReq.ContentLength == 0 {
+		proxyReq.Body = http.NoBody
+	} else {
+		proxyReq.Body = io.NopCloser(body.NewReader())
+		proxyReq.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(body.NewReader()), nil
+		}
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(reqBodyBytes))
 
-	hasher.Write(reqBodyBytes)
-	digest := hasher.Sum(nil)
+	// Add origin headers after request is signed (no overwrite)
+	copyHeaderWithoutOverwrite(proxyReq.Header, req.Header)
 
-	return hex.EncodeToString(digest), nil
+	return proxyReq, nil
 }
+
+// send makes a single attempt at the upstream request.
+func (p *ProxyClient) send(ctx context.Context, proxyReq *http.Request, body *spool, attempt int) (*http.Response, error) {
+	ctx, span := p.tracer(ctx).Start(ctx, "upstream round trip", trace.WithAttributes(attribute.Int("attempt", attempt)))
+
+	// Propagate our trace context upstream instead of the incoming one, it is not part of the signature.
+	traceContext.Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	if log.GetLevel() == log.DebugLevel {
+		dumpRequest("proxying request", proxyReq, body)
+	}
+
+	resp, err := p.Client.Do(proxyReq)
+	if resp != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	}
+	endSpan(span, err)
+
+	return resp, err
+}
+
+const (
+	emptyStringSHA256 = `e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`
+)
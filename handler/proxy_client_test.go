@@ -16,10 +16,14 @@
 package handler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 
@@ -43,6 +47,22 @@ func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	return &http.Response{}, nil
 }
 
+// bodyReadingHTTPClient consumes the request body like a real transport would.
+type bodyReadingHTTPClient struct {
+	Request *http.Request
+	Body    []byte
+}
+
+func (m *bodyReadingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	m.Request = req
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.Body = b
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+}
+
 type mockProvider struct {
 	credentials.Provider
 	Fail bool
@@ -325,3 +345,129 @@ func verifyRequest(received *http.Request, expected *http.Request) bool {
 
 	return received.Host == expected.Host
 }
+
+func TestProxyClient_DoSpoolsBody(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"index":{}}`+"\n"+`{"field":"value"}`+"\n"), 1024)
+	sum := sha256.Sum256(payload)
+
+	tests := []struct {
+		name             string
+		memoryBufferSize int64
+		wantFiles        int
+	}{
+		{
+			name:             "should keep small bodies in memory",
+			memoryBufferSize: int64(len(payload)),
+			wantFiles:        0,
+		},
+		{
+			name:             "should spill large bodies to disk until the response is closed",
+			memoryBufferSize: 1024,
+			wantFiles:        1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			client := &bodyReadingHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:              client,
+				SigningNameOverride: "aoss",
+				RegionOverride:      "us-west-2",
+				MemoryBufferSize:    tt.memoryBufferSize,
+				TempDir:             tempDir,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        "POST",
+				URL:           &url.URL{Path: "/_bulk"},
+				Host:          "abcdefgh.us-west-2.aoss.amazonaws.com",
+				Header:        http.Header{},
+				ContentLength: -1,
+				Body:          io.NopCloser(bytes.NewReader(payload)),
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, payload, client.Body)
+			assert.Equal(t, int64(len(payload)), client.Request.ContentLength)
+			assert.Equal(t, hex.EncodeToString(sum[:]), client.Request.Header.Get("X-Amz-Content-Sha256"))
+
+			files, _ := os.ReadDir(tempDir)
+			assert.Len(t, files, tt.wantFiles)
+
+			assert.NoError(t, resp.Body.Close())
+			files, _ = os.ReadDir(tempDir)
+			assert.Len(t, files, 0)
+		})
+	}
+}
+
+func TestProxyClient_DoPresignedBody(t *testing.T) {
+	client := &bodyReadingHTTPClient{}
+	proxyClient := &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client: client,
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method:        "PUT",
+		URL:           &url.URL{Path: "/bucket/key"},
+		Host:          "s3.amazonaws.com",
+		Header:        http.Header{},
+		ContentLength: 5,
+		Body:          io.NopCloser(strings.NewReader("hello")),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "hello", string(client.Body))
+	assert.Equal(t, int64(5), client.Request.ContentLength)
+	body, err := client.Request.GetBody()
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(body)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestProxyClient_DoMaxBodySize(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength int64
+	}{
+		{
+			name:          "should reject bodies with a declared length over the limit",
+			contentLength: 11,
+		},
+		{
+			name:          "should reject chunked bodies growing over the limit",
+			contentLength: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:      v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+				Client:      client,
+				MaxBodySize: 10,
+			}
+
+			resp, err := proxyClient.Do(&http.Request{
+				Method:        "PUT",
+				URL:           &url.URL{},
+				Host:          "execute-api.us-west-2.amazonaws.com",
+				ContentLength: tt.contentLength,
+				Body:          io.NopCloser(strings.NewReader("hello world")),
+			})
+
+			assert.Nil(t, resp)
+			assert.Equal(t, &BodyTooLargeError{Limit: 10}, err)
+			assert.Nil(t, client.Request)
+		})
+	}
+}
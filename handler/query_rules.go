@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryRule drops or rewrites the query parameters of the requests whose path matches Path, before
+// they are signed.
+type QueryRule struct {
+	Path *regexp.Regexp
+	// Methods the rule applies to, any method when empty.
+	Methods []string
+	// Drop lists the parameters removed.
+	Drop []string
+	// Rewrite maps parameters to the value they are given, when they are present.
+	Rewrite map[string]string
+}
+
+func (q *QueryRule) matches(method, path string) bool {
+	if len(q.Methods) > 0 && !containsFold(q.Methods, method) {
+		return false
+	}
+
+	return q.Path.MatchString(path)
+}
+
+// AOSSQueryRules drop the query parameters AOSS answers with a 400 for, whose effect it has no use for.
+func AOSSQueryRules() []QueryRule {
+	return []QueryRule{
+		{
+			// Shards are managed by AOSS
+			Path: regexp.MustCompile(`.*`),
+			Drop: []string{"wait_for_active_shards"},
+		},
+		{
+			Path: regexp.MustCompile(`^/_cluster(/|$)`),
+			Drop: []string{"timeout", "master_timeout", "cluster_manager_timeout"},
+		},
+		{
+			Path: regexp.MustCompile(`^/[^_/][^/]*(/_(mapping|mappings|settings|alias|aliases)(/.*)?)?/?$`),
+			Drop: []string{"timeout", "master_timeout", "cluster_manager_timeout"},
+		},
+		{
+			// Neither shard routing nor shard request caches are exposed
+			Path: regexp.MustCompile(`/_(search|msearch|count|mget|doc|create|update|bulk)(/|$)`),
+			Drop: []string{"preference", "routing", "request_cache"},
+		},
+		{
+			// Emulated by RefreshWaiter
+			Path:    regexp.MustCompile(`/_(doc|create|update|bulk)(/|$)`),
+			Methods: []string{"PUT", "POST", "DELETE"},
+			Drop:    []string{"refresh"},
+		},
+	}
+}
+
+// applyQueryRules drops and rewrites the query parameters of u according to the rules matching the
+// request, leaving the query untouched when none applies.
+func applyQueryRules(rules []QueryRule, method string, u *url.URL) {
+	if u.RawQuery == "" {
+		return
+	}
+
+	query := u.Query()
+	var dropped, rewritten []string
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(method, u.Path) {
+			continue
+		}
+		for _, param := range rule.Drop {
+			if _, ok := query[param]; ok {
+				query.Del(param)
+				dropped = append(dropped, param)
+			}
+		}
+		for param, value := range rule.Rewrite {
+			if _, ok := query[param]; ok {
+				query.Set(param, value)
+				rewritten = append(rewritten, param)
+			}
+		}
+	}
+	if len(dropped) == 0 && len(rewritten) == 0 {
+		return
+	}
+
+	sort.Strings(rewritten)
+	log.WithFields(log.Fields{
+		"path":      u.Path,
+		"dropped":   strings.Join(dropped, ","),
+		"rewritten": strings.Join(rewritten, ","),
+	}).Debug("Applied query parameter rules")
+
+	u.RawQuery = query.Encode()
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyQueryRules(t *testing.T) {
+	rules := append(AOSSQueryRules(), QueryRule{
+		Path:    regexp.MustCompile(`/_search$`),
+		Rewrite: map[string]string{"search_type": "query_then_fetch"},
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   string
+	}{
+		{
+			name:   "should drop wait_for_active_shards everywhere",
+			method: "PUT",
+			target: "/logs/_doc/1?wait_for_active_shards=2&op_type=create",
+			want:   "op_type=create",
+		},
+		{
+			name:   "should drop timeouts on cluster APIs",
+			method: "PUT",
+			target: "/_cluster/settings?timeout=30s&master_timeout=1m&flat_settings=true",
+			want:   "flat_settings=true",
+		},
+		{
+			name:   "should drop timeouts on index APIs",
+			method: "PUT",
+			target: "/logs/_mapping?timeout=30s",
+			want:   "",
+		},
+		{
+			name:   "should drop shard routing and caching on search",
+			method: "POST",
+			target: "/logs/_search?preference=_local&routing=a&request_cache=true&size=10",
+			want:   "size=10",
+		},
+		{
+			name:   "should rewrite parameters",
+			method: "POST",
+			target: "/logs/_search?search_type=dfs_query_then_fetch",
+			want:   "search_type=query_then_fetch",
+		},
+		{
+			name:   "should only drop refresh on writes",
+			method: "GET",
+			target: "/logs/_doc/1?refresh=true",
+			want:   "refresh=true",
+		},
+		{
+			name:   "should leave untouched queries as they are",
+			method: "GET",
+			target: "/logs/_search?q=a%20b&size=1",
+			want:   "q=a%20b&size=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.target)
+			assert.NoError(t, err)
+
+			applyQueryRules(rules, tt.method, u)
+
+			assert.Equal(t, tt.want, u.RawQuery)
+		})
+	}
+}
+
+func TestProxyClient_DoQueryRules(t *testing.T) {
+	client := &scriptedHTTPClient{Statuses: []int{http.StatusOK}}
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              client,
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+		QueryRules:          AOSSQueryRules(),
+	}
+
+	_, err := proxyClient.Do(&http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/logs/_search", RawQuery: "preference=_local&size=1"},
+		Host:   "rules.host",
+		Header: http.Header{},
+	})
+
+	assert.NoError(t, err)
+	if assert.Len(t, client.Requests, 1) {
+		assert.Equal(t, "size=1", client.Requests[0].URL.RawQuery)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// refreshAPIs are the write APIs whose refresh parameter is emulated.
+var refreshAPIs = map[string]bool{
+	"_bulk":   true,
+	"_create": true,
+	"_doc":    true,
+	"_update": true,
+}
+
+// RefreshWaiter strips the refresh parameter AOSS does not support from the write APIs. With
+// refresh=true or refresh=wait_for, the response is held until the written documents are visible to
+// _mget, every Interval until Timeout expires, and with refresh=true it reports forced_refresh like
+// OpenSearch. Other requests are served by Next.
+type RefreshWaiter struct {
+	Client   Client
+	Next     http.Handler
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// writtenDoc is a document written by a request, which is visible once _mget finds it, or no longer
+// finds it when it was deleted.
+type writtenDoc struct {
+	Index   string `json:"_index"`
+	ID      string `json:"_id"`
+	deleted bool
+}
+
+func (h *RefreshWaiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api := requestAPIFamily(r)
+	query := r.URL.Query()
+	refresh, ok := query["refresh"]
+	if !ok || !refreshAPIs[api] || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	r = r.Clone(r.Context())
+	query.Del("refresh")
+	r.URL.RawQuery = query.Encode()
+
+	// A bare refresh stands for refresh=true
+	mode := refresh[0]
+	if mode == "" {
+		mode = "true"
+	}
+	if mode != "true" && mode != "wait_for" {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	// The response is read to find the written documents
+	r.Header.Del("Accept-Encoding")
+	rec := &bufferedResponse{header: http.Header{}}
+	h.Next.ServeHTTP(rec, r)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	body := rec.body.Bytes()
+	if rec.status < 300 {
+		if docs := writtenDocs(api, body); len(docs) > 0 {
+			h.wait(r, docs)
+		}
+		if mode == "true" {
+			body = forceRefreshed(api, body)
+		}
+	}
+
+	// Trailers set by Next after the body are sent after the body again, as announced
+	trailers := announcedTrailers(rec.header)
+	for k, vals := range rec.header {
+		if k != "Trailer" && !trailers[k] {
+			w.Header()[k] = vals
+		}
+	}
+	if announced := rec.header.Values("Trailer"); len(announced) > 0 {
+		w.Header()["Trailer"] = announced
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(rec.status)
+	w.Write(body)
+
+	for k := range trailers {
+		if vals, ok := rec.header[k]; ok {
+			w.Header()[k] = vals
+		}
+	}
+}
+
+// announcedTrailers returns the canonical keys of the trailers announced by the Trailer header.
+func announcedTrailers(header http.Header) map[string]bool {
+	trailers := map[string]bool{}
+	for _, announced := range header.Values("Trailer") {
+		for _, k := range strings.Split(announced, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				trailers[http.CanonicalHeaderKey(k)] = true
+			}
+		}
+	}
+
+	return trailers
+}
+
+// wait polls _mget until every document is visible, or Timeout expires.
+func (h *RefreshWaiter) wait(r *http.Request, docs []writtenDoc) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	pending := docs
+	for {
+		var result struct {
+			Docs []struct {
+				Found bool `json:"found"`
+			} `json:"docs"`
+		}
+		err := postJSON(ctx, h.Client, r.Host, "/_mget", map[string]interface{}{"docs": pending}, &result)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("unable to check written documents, answering without waiting for them")
+			return
+		}
+
+		if err == nil {
+			var still []writtenDoc
+			for i, doc := range pending {
+				if i >= len(result.Docs) || result.Docs[i].Found == doc.deleted {
+					still = append(still, doc)
+				}
+			}
+			pending = still
+		}
+		if len(pending) == 0 {
+			log.WithFields(log.Fields{"documents": len(docs), "elapsed": time.Since(start)}).Debug("written documents are visible")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			if r.Context().Err() == nil {
+				log.WithFields(log.Fields{"documents": len(docs), "pending": len(pending), "timeout": h.Timeout}).Warn("written documents still not visible, answering anyway")
+			}
+			return
+		case <-time.After(h.Interval):
+		}
+	}
+}
+
+// writtenDocs returns the documents successfully written according to the response of a write API.
+func writtenDocs(api string, body []byte) []writtenDoc {
+	type result struct {
+		writtenDoc
+		Status int    `json:"status"`
+		Result string `json:"result"`
+	}
+
+	if api != "_bulk" {
+		var doc result
+		if err := json.Unmarshal(body, &doc); err != nil || doc.ID == "" {
+			return nil
+		}
+		doc.deleted = doc.Result == "deleted" || doc.Result == "not_found"
+		return []writtenDoc{doc.writtenDoc}
+	}
+
+	var bulk struct {
+		Items []map[string]result `json:"items"`
+	}
+	if err := json.Unmarshal(body, &bulk); err != nil {
+		return nil
+	}
+
+	var docs []writtenDoc
+	for _, item := range bulk.Items {
+		for op, doc := range item {
+			if doc.Status >= 300 || doc.ID == "" {
+				continue
+			}
+			doc.deleted = op == "delete"
+			docs = append(docs, doc.writtenDoc)
+		}
+	}
+
+	return docs
+}
+
+// forceRefreshed sets forced_refresh on the response of a write API, or on its successful items for
+// _bulk, like OpenSearch does on refresh=true.
+func forceRefreshed(api string, body []byte) []byte {
+	forced := json.RawMessage("true")
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body
+	}
+
+	if api != "_bulk" {
+		doc["forced_refresh"] = forced
+	} else {
+		var items []map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(doc["items"], &items); err != nil {
+			return body
+		}
+		for _, item := range items {
+			for _, result := range item {
+				var status int
+				if json.Unmarshal(result["status"], &status) == nil && status < 300 {
+					result["forced_refresh"] = forced
+				}
+			}
+		}
+		b, err := json.Marshal(items)
+		if err != nil {
+			return body
+		}
+		doc["items"] = b
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return body
+	}
+
+	return b
+}
+
+// bufferedResponse holds a response for it to be rewritten before being sent to the client.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	return b.body.Write(p)
+}
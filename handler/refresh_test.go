@@ -0,0 +1,187 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mgetUpstream answers _mget requests, finding documents once they were asked for visibleAfter times.
+type mgetUpstream struct {
+	visibleAfter int
+	requests     int
+}
+
+func (u *mgetUpstream) Do(req *http.Request) (*http.Response, error) {
+	u.requests++
+
+	var body struct {
+		Docs []map[string]string `json:"docs"`
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+
+	var docs []map[string]interface{}
+	for _, doc := range body.Docs {
+		// Deleted documents are named after it, and found until they become visible
+		visible := u.requests > u.visibleAfter
+		found := visible
+		if strings.HasPrefix(doc["_id"], "deleted") {
+			found = !visible
+		}
+		docs = append(docs, map[string]interface{}{"_index": doc["_index"], "_id": doc["_id"], "found": found})
+	}
+	b, _ := json.Marshal(map[string]interface{}{"docs": docs})
+
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(b)))}, nil
+}
+
+func TestRefreshWaiter_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		response     string
+		visibleAfter int
+		timeout      time.Duration
+		wantQuery    string
+		want         string
+		wantRequests int
+	}{
+		{
+			name:         "should wait for the written document and report a forced refresh",
+			method:       "PUT",
+			target:       "/logs/_doc/1?refresh=true&routing=a",
+			response:     `{"_index":"logs","_id":"1","result":"created"}`,
+			visibleAfter: 2,
+			timeout:      time.Second,
+			wantQuery:    "routing=a",
+			want:         `{"_index":"logs","_id":"1","result":"created","forced_refresh":true}`,
+			wantRequests: 3,
+		},
+		{
+			name:         "should take a bare refresh for refresh=true",
+			method:       "POST",
+			target:       "/logs/_update/1?refresh",
+			response:     `{"_index":"logs","_id":"1","result":"updated"}`,
+			timeout:      time.Second,
+			want:         `{"_index":"logs","_id":"1","result":"updated","forced_refresh":true}`,
+			wantRequests: 1,
+		},
+		{
+			name:         "should wait for deleted documents to be gone without reporting a forced refresh",
+			method:       "DELETE",
+			target:       "/logs/_doc/deleted-1?refresh=wait_for",
+			response:     `{"_index":"logs","_id":"deleted-1","result":"deleted"}`,
+			visibleAfter: 1,
+			timeout:      time.Second,
+			want:         `{"_index":"logs","_id":"deleted-1","result":"deleted"}`,
+			wantRequests: 2,
+		},
+		{
+			name:         "should wait for the successful items of bulk requests",
+			method:       "POST",
+			target:       "/_bulk?refresh=true",
+			response:     `{"took":1,"errors":true,"items":[{"index":{"_index":"logs","_id":"1","status":201}},{"create":{"_index":"logs","_id":"2","status":409}}]}`,
+			timeout:      time.Second,
+			want:         `{"took":1,"errors":true,"items":[{"index":{"_index":"logs","_id":"1","status":201,"forced_refresh":true}},{"create":{"_index":"logs","_id":"2","status":409}}]}`,
+			wantRequests: 1,
+		},
+		{
+			name:         "should answer once the timeout expires",
+			method:       "PUT",
+			target:       "/logs/_doc/1?refresh=wait_for",
+			response:     `{"_index":"logs","_id":"1","result":"created"}`,
+			visibleAfter: 1000,
+			timeout:      20 * time.Millisecond,
+			want:         `{"_index":"logs","_id":"1","result":"created"}`,
+		},
+		{
+			name:      "should only strip refresh=false",
+			method:    "PUT",
+			target:    "/logs/_doc/1?refresh=false",
+			response:  `{"_index":"logs","_id":"1","result":"created"}`,
+			timeout:   time.Second,
+			wantQuery: "",
+			want:      `{"_index":"logs","_id":"1","result":"created"}`,
+		},
+		{
+			name:      "should leave other APIs alone",
+			method:    "POST",
+			target:    "/logs/_search?refresh=true",
+			response:  `{"hits":{}}`,
+			timeout:   time.Second,
+			wantQuery: "refresh=true",
+			want:      `{"hits":{}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &mgetUpstream{visibleAfter: tt.visibleAfter}
+			query := ""
+			h := &RefreshWaiter{
+				Client: upstream,
+				Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					query = r.URL.RawQuery
+					w.Write([]byte(tt.response))
+				}),
+				Interval: time.Millisecond,
+				Timeout:  tt.timeout,
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.wantQuery, query)
+			assert.JSONEq(t, tt.want, rec.Body.String())
+			if tt.wantRequests != 0 {
+				assert.Equal(t, tt.wantRequests, upstream.requests)
+			}
+		})
+	}
+}
+
+func TestRefreshWaiter_ServeHTTPForwardsTrailers(t *testing.T) {
+	h := &RefreshWaiter{
+		Client: &mgetUpstream{},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"_index":"logs","_id":"1","result":"created"}`))
+			w.Header().Set("X-Checksum", "abc")
+		}),
+		Interval: time.Millisecond,
+		Timeout:  time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/logs/_doc/1?refresh=wait_for", nil))
+
+	response := rec.Result()
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.Equal(t, "X-Checksum", response.Header.Get("Trailer"))
+	assert.Empty(t, response.Header.Get("X-Checksum"))
+	assert.Equal(t, "abc", response.Trailer.Get("X-Checksum"))
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides which failed upstream requests are attempted again and how long to wait in between.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, doubled on every following one.
+	BaseBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. A Retry-After asking for longer is not retried.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the backoff that is randomised, between 0 and 1.
+	Jitter float64
+	// StatusCodes are the upstream statuses worth retrying. Transport errors are always retried.
+	StatusCodes []int
+	// Methods are the HTTP methods safe to retry.
+	Methods []string
+	// APIs are the OpenSearch API families safe to retry regardless of their method, such as _bulk.
+	APIs []string
+}
+
+// next reports whether a failed attempt should be retried and how long to wait before doing so.
+func (r *RetryPolicy) next(attempt int, method, api string, resp *http.Response, err error) (time.Duration, bool) {
+	if r == nil || attempt >= r.MaxAttempts || !r.retryable(method, api) {
+		return 0, false
+	}
+
+	if err != nil {
+		// The client went away, there is nobody left to retry for
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, false
+		}
+		return r.backoff(attempt), true
+	}
+
+	if !containsInt(r.StatusCodes, resp.StatusCode) {
+		return 0, false
+	}
+
+	if wait, ok := retryAfter(resp.Header, time.Now()); ok {
+		if r.MaxBackoff > 0 && wait > r.MaxBackoff {
+			return 0, false
+		}
+		return wait, true
+	}
+
+	return r.backoff(attempt), true
+}
+
+func (r *RetryPolicy) retryable(method, api string) bool {
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	for _, a := range r.APIs {
+		if a == api {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff is the exponential wait after the given attempt, with jitter applied.
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := r.BaseBackoff
+	for i := 1; i < attempt && (r.MaxBackoff <= 0 || wait < r.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if r.MaxBackoff > 0 && wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+
+	if r.Jitter > 0 {
+		wait -= time.Duration(r.Jitter * rand.Float64() * float64(wait))
+	}
+
+	return wait
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(v); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// sleep waits for d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
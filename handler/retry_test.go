@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_next(t *testing.T) {
+	policy := &RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: 100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+		StatusCodes: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		Methods:     []string{"GET", "PUT"},
+		APIs:        []string{"_bulk"},
+	}
+
+	response := func(status int, header http.Header) *http.Response {
+		return &http.Response{StatusCode: status, Header: header}
+	}
+
+	tests := []struct {
+		name      string
+		policy    *RetryPolicy
+		attempt   int
+		method    string
+		api       string
+		resp      *http.Response
+		err       error
+		wantWait  time.Duration
+		wantRetry bool
+	}{
+		{
+			name:      "should not retry without a policy",
+			policy:    nil,
+			attempt:   1,
+			method:    "GET",
+			resp:      response(http.StatusTooManyRequests, http.Header{}),
+			wantRetry: false,
+		},
+		{
+			name:      "should retry throttled idempotent requests with backoff",
+			policy:    policy,
+			attempt:   2,
+			method:    "GET",
+			resp:      response(http.StatusTooManyRequests, http.Header{}),
+			wantWait:  200 * time.Millisecond,
+			wantRetry: true,
+		},
+		{
+			name:      "should retry bulk requests",
+			policy:    policy,
+			attempt:   1,
+			method:    "POST",
+			api:       "_bulk",
+			resp:      response(http.StatusServiceUnavailable, http.Header{}),
+			wantWait:  100 * time.Millisecond,
+			wantRetry: true,
+		},
+		{
+			name:      "should not retry other non idempotent requests",
+			policy:    policy,
+			attempt:   1,
+			method:    "POST",
+			api:       "_doc",
+			resp:      response(http.StatusTooManyRequests, http.Header{}),
+			wantRetry: false,
+		},
+		{
+			name:      "should not retry other status codes",
+			policy:    policy,
+			attempt:   1,
+			method:    "GET",
+			resp:      response(http.StatusBadRequest, http.Header{}),
+			wantRetry: false,
+		},
+		{
+			name:      "should stop after the maximum attempts",
+			policy:    policy,
+			attempt:   3,
+			method:    "GET",
+			resp:      response(http.StatusTooManyRequests, http.Header{}),
+			wantRetry: false,
+		},
+		{
+			name:      "should honour Retry-After",
+			policy:    policy,
+			attempt:   1,
+			method:    "GET",
+			resp:      response(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"1"}}),
+			wantWait:  time.Second,
+			wantRetry: true,
+		},
+		{
+			name:      "should not wait longer than the maximum backoff",
+			policy:    policy,
+			attempt:   1,
+			method:    "GET",
+			resp:      response(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"30"}}),
+			wantRetry: false,
+		},
+		{
+			name:      "should retry transport errors",
+			policy:    policy,
+			attempt:   1,
+			method:    "GET",
+			err:       fmt.Errorf("connection reset by peer"),
+			wantWait:  100 * time.Millisecond,
+			wantRetry: true,
+		},
+		{
+			name:      "should not retry once the client went away",
+			policy:    policy,
+			attempt:   1,
+			method:    "GET",
+			err:       fmt.Errorf("request failed: %w", context.Canceled),
+			wantRetry: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, retry := tt.policy.next(tt.attempt, tt.method, tt.api, tt.resp, tt.err)
+
+			assert.Equal(t, tt.wantRetry, retry)
+			assert.Equal(t, tt.wantWait, wait)
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := &RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		wait := policy.backoff(attempt)
+		assert.LessOrEqual(t, wait, time.Second)
+		assert.GreaterOrEqual(t, wait, 50*time.Millisecond)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 21, 0, 0, 0, 0, time.UTC)
+
+	wait, ok := retryAfter(http.Header{"Retry-After": []string{"Sat, 21 Jan 2023 00:00:05 GMT"}}, now)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, wait)
+
+	_, ok = retryAfter(http.Header{"Retry-After": []string{"soon"}}, now)
+	assert.False(t, ok)
+}
+
+// scriptedHTTPClient answers with the given statuses in turn, recording the bodies it received.
+type scriptedHTTPClient struct {
+	Statuses []int
+	Bodies   []string
+	Requests []*http.Request
+}
+
+func (m *scriptedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	b, _ := io.ReadAll(req.Body)
+	m.Bodies = append(m.Bodies, string(b))
+	m.Requests = append(m.Requests, req)
+
+	status := m.Statuses[len(m.Requests)-1]
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(http.StatusText(status))),
+	}, nil
+}
+
+func TestProxyClient_DoRetries(t *testing.T) {
+	client := &scriptedHTTPClient{Statuses: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK}}
+	proxyClient := &ProxyClient{
+		Signer:              v4.NewSigner(credentials.NewCredentials(&mockProvider{})),
+		Client:              client,
+		SigningNameOverride: "aoss",
+		RegionOverride:      "us-west-2",
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			BaseBackoff: time.Millisecond,
+			StatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway},
+			APIs:        []string{"_bulk"},
+		},
+	}
+
+	payload := `{"index":{"_index":"logs"}}` + "\n" + `{"message":"hello"}` + "\n"
+	resp, err := proxyClient.Do(&http.Request{
+		Method:        "POST",
+		URL:           &url.URL{Path: "/_bulk"},
+		Host:          "retry.host",
+		Header:        http.Header{},
+		ContentLength: int64(len(payload)),
+		Body:          io.NopCloser(strings.NewReader(payload)),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{payload, payload, payload}, client.Bodies)
+	for _, req := range client.Requests {
+		assert.NotEmpty(t, req.Header.Get("Authorization"))
+		assert.Len(t, req.Header.Values("Authorization"), 1)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// RoleSigner signs the requests of the clients it is mapped to with the credentials of its role.
+type RoleSigner struct {
+	// Name selects the role through the trusted role header.
+	Name    string
+	RoleARN string
+	// Principals are the clients whose requests are signed with the role, principal names,
+	// group:<name> for the members of a group, or * for anyone.
+	Principals []string
+	Signer     *v4.Signer
+}
+
+// UnknownRoleError is returned when the role header names no role of the route.
+type UnknownRoleError struct {
+	Role string
+}
+
+func (e *UnknownRoleError) Error() string {
+	return fmt.Sprintf("no role named [%s]", e.Role)
+}
+
+// RoleNotAllowedError is returned when the role header names a role the client is not mapped to.
+type RoleNotAllowedError struct {
+	Role      string
+	Principal string
+}
+
+func (e *RoleNotAllowedError) Error() string {
+	return fmt.Sprintf("role [%s] is not allowed for User [name=%s]", e.Role, e.Principal)
+}
+
+type roleKey struct{}
+
+// roleSelection is the role named by the role header of a request, trusted when the client may
+// select any role.
+type roleSelection struct {
+	name    string
+	trusted bool
+}
+
+// WithRole returns a copy of ctx carrying the name of the role selected for the request. Roles
+// selected by trusted clients are used whatever the clients they are mapped to.
+func WithRole(ctx context.Context, name string, trusted bool) context.Context {
+	return context.WithValue(ctx, roleKey{}, roleSelection{name: name, trusted: trusted})
+}
+
+// RoleFrom returns the name of the role selected for a request, empty when none was, and whether it
+// was selected by a trusted client.
+func RoleFrom(ctx context.Context) (string, bool) {
+	selection, _ := ctx.Value(roleKey{}).(roleSelection)
+	return selection.name, selection.trusted
+}
+
+// detachedContext returns a context carrying the principal and role of ctx, without its deadline
+// and cancellation, for work shared with other requests.
+func detachedContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	if principal := PrincipalFrom(ctx); principal != nil {
+		detached = WithPrincipal(detached, principal)
+	}
+	if name, trusted := RoleFrom(ctx); name != "" {
+		detached = WithRole(detached, name, trusted)
+	}
+
+	return detached
+}
+
+// RoleHeader lets clients select the role requests are signed with through Header, among the roles
+// they are mapped to. TrustedCallers, such as a gateway in front of the proxy, may select any role.
+// The header is removed before the request is signed.
+type RoleHeader struct {
+	Header string
+	// TrustedCallers are principal names, group:<name> for the members of a group, or * for anyone.
+	TrustedCallers []string
+	Next           http.Handler
+}
+
+func (h *RoleHeader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if name := r.Header.Get(h.Header); name != "" {
+		trusted := PrincipalFrom(r.Context()).matches(h.TrustedCallers)
+		r = r.Clone(WithRole(r.Context(), name, trusted))
+		r.Header.Del(h.Header)
+	}
+
+	h.Next.ServeHTTP(w, r)
+}
+
+// role returns the role selected for the request, or mapped to its client, nil when there is none.
+func (p *ProxyClient) role(ctx context.Context) (*RoleSigner, error) {
+	principal := PrincipalFrom(ctx)
+	if name, trusted := RoleFrom(ctx); name != "" {
+		for i := range p.Roles {
+			if p.Roles[i].Name != name {
+				continue
+			}
+			if !trusted && !principal.matches(p.Roles[i].Principals) {
+				return nil, &RoleNotAllowedError{Role: name, Principal: principalName(principal)}
+			}
+			return &p.Roles[i], nil
+		}
+		return nil, &UnknownRoleError{Role: name}
+	}
+
+	for i := range p.Roles {
+		if principal.matches(p.Roles[i].Principals) {
+			return &p.Roles[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// signer returns the signer of the role of the request. Requests without a role are signed with Signer.
+func (p *ProxyClient) signer(ctx context.Context) (*v4.Signer, error) {
+	role, err := p.role(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return p.Signer, nil
+	}
+
+	return role.Signer, nil
+}
+
+// clientRole returns the name of the role client signs the requests of ctx with, empty for its default
+// credentials and for clients without roles.
+func clientRole(ctx context.Context, client Client) (string, error) {
+	p, ok := client.(*ProxyClient)
+	if !ok {
+		return "", nil
+	}
+
+	role, err := p.role(ctx)
+	if err != nil || role == nil {
+		return "", err
+	}
+
+	return role.Name, nil
+}
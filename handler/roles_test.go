@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyClient_DoRoles(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      string
+		trusted   bool
+		principal *Principal
+		wantKey   string
+		wantErr   error
+	}{
+		{name: "should sign with the default credentials", principal: &Principal{Name: "alice"}, wantKey: "AKIDDEFAULT"},
+		{name: "should sign with the role of the principal", principal: &Principal{Name: "fluent-bit"}, wantKey: "AKIDINGEST"},
+		{name: "should sign with the first role of the principal", principal: &Principal{Name: "bob", Groups: []string{"analysts", "ingest"}}, wantKey: "AKIDINGEST"},
+		{name: "should sign with the role of the group", principal: &Principal{Name: "bob", Groups: []string{"analysts"}}, wantKey: "AKIDREAD"},
+		{name: "should sign with the role of the header", role: "read", principal: &Principal{Name: "bob", Groups: []string{"analysts", "ingest"}}, wantKey: "AKIDREAD"},
+		{
+			name: "should reject roles of other clients", role: "read", principal: &Principal{Name: "fluent-bit"},
+			wantErr: &RoleNotAllowedError{Role: "read", Principal: "fluent-bit"},
+		},
+		{name: "should sign with any role selected by trusted callers", role: "read", trusted: true, principal: &Principal{Name: "gateway"}, wantKey: "AKIDREAD"},
+		{name: "should reject unknown roles", role: "admin", wantErr: &UnknownRoleError{Role: "admin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scriptedHTTPClient{Statuses: []int{http.StatusOK}}
+			proxyClient := &ProxyClient{
+				Signer: v4.NewSigner(credentials.NewStaticCredentials("AKIDDEFAULT", "secret", "")),
+				Client: client,
+				Roles: []RoleSigner{
+					{Name: "ingest", Principals: []string{"fluent-bit", "group:ingest"}, Signer: v4.NewSigner(credentials.NewStaticCredentials("AKIDINGEST", "secret", ""))},
+					{Name: "read", Principals: []string{"group:analysts"}, Signer: v4.NewSigner(credentials.NewStaticCredentials("AKIDREAD", "secret", ""))},
+				},
+				SigningNameOverride: "aoss",
+				RegionOverride:      "us-west-2",
+			}
+
+			ctx := WithPrincipal(context.Background(), tt.principal)
+			if tt.role != "" {
+				ctx = WithRole(ctx, tt.role, tt.trusted)
+			}
+			req := (&http.Request{Method: "GET", URL: &url.URL{Path: "/logs/_search"}, Host: "roles.host", Header: http.Header{}}).WithContext(ctx)
+
+			_, err := proxyClient.Do(req)
+
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil && assert.Len(t, client.Requests, 1) {
+				assert.Contains(t, client.Requests[0].Header.Get("Authorization"), "Credential="+tt.wantKey+"/")
+			}
+		})
+	}
+}
+
+func TestRoleHeader(t *testing.T) {
+	var role, header string
+	var trusted bool
+	h := &RoleHeader{Header: "X-Proxy-Role", TrustedCallers: []string{"gateway"}, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, trusted = RoleFrom(r.Context())
+		header = r.Header.Get("X-Proxy-Role")
+	})}
+
+	tests := []struct {
+		name        string
+		principal   string
+		wantTrusted bool
+	}{
+		{name: "should trust trusted callers", principal: "gateway", wantTrusted: true},
+		{name: "should not trust other clients", principal: "fluent-bit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(WithPrincipal(req.Context(), &Principal{Name: tt.principal}))
+			req.Header.Set("X-Proxy-Role", "ingest")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, "ingest", role)
+			assert.Equal(t, tt.wantTrusted, trusted)
+			assert.Empty(t, header)
+		})
+	}
+}
+
+func TestHandler_ServeHTTPRoleNotAllowed(t *testing.T) {
+	h := &Handler{ProxyClient: &ProxyClient{
+		Signer: v4.NewSigner(credentials.NewStaticCredentials("AKIDDEFAULT", "secret", "")),
+		Client: &scriptedHTTPClient{Statuses: []int{http.StatusOK}},
+		Roles:  []RoleSigner{{Name: "ingest", Principals: []string{"fluent-bit"}}},
+	}}
+	req := httptest.NewRequest("GET", "/logs/_search", nil)
+	req = req.WithContext(WithRole(WithPrincipal(req.Context(), &Principal{Name: "alice"}), "ingest", false))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "role [ingest] is not allowed for User [name=alice]")
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Route sends the requests matching Host and PathPrefix to Handler.
+type Route struct {
+	Name        string
+	Host        string
+	PathPrefix  string
+	StripPrefix bool
+	Handler     http.Handler
+}
+
+func (r *Route) matches(req *http.Request) bool {
+	if r.Host != "" && !strings.EqualFold(r.Host, req.Host) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil || !strings.EqualFold(r.Host, host) {
+			return false
+		}
+	}
+
+	return hasPathPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// hasPathPrefix matches prefix against whole path segments, so /logs matches /logs/_search but not /logstash.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Router dispatches requests to the first matching route, in the order the routes were given.
+// Routes can be replaced while serving, requests already dispatched finish on the previous ones.
+type Router struct {
+	routes atomic.Value
+}
+
+func NewRouter(routes []Route) *Router {
+	rt := &Router{}
+	rt.SetRoutes(routes)
+	return rt
+}
+
+// SetRoutes atomically replaces the routes.
+func (rt *Router) SetRoutes(routes []Route) {
+	rt.routes.Store(routes)
+}
+
+// Routes returns the current routes.
+func (rt *Router) Routes() []Route {
+	routes, _ := rt.routes.Load().([]Route)
+	return routes
+}
+
+// Match returns the route for a request, or nil when none matches.
+func (rt *Router) Match(req *http.Request) *Route {
+	routes := rt.Routes()
+	for i := range routes {
+		if routes[i].matches(req) {
+			return &routes[i]
+		}
+	}
+
+	return nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rt.Match(r)
+	if route == nil {
+		errorMsg := "no route matches request"
+		log.WithField("host", r.Host).WithField("path", r.URL.Path).Warn(errorMsg)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("%v - %v %v", errorMsg, r.Host, r.URL.Path)))
+		return
+	}
+
+	log.WithField("route", route.Name).Debug("routing request")
+
+	if route.StripPrefix {
+		r = stripPrefix(r, route.PathPrefix)
+	}
+	route.Handler.ServeHTTP(w, r)
+}
+
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+
+	r2.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.RawPath, prefix), "/")
+	}
+
+	return r2
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pathRecorder answers with its name and the path it received.
+type pathRecorder string
+
+func (p pathRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(string(p) + " " + r.URL.Path))
+}
+
+func TestRouter_ServeHTTP(t *testing.T) {
+	router := NewRouter([]Route{
+		{Name: "logs", Host: "logs.local", Handler: pathRecorder("logs")},
+		{Name: "aps", PathPrefix: "/aps", StripPrefix: true, Handler: pathRecorder("aps")},
+		{Name: "metrics", PathPrefix: "/metrics/", Handler: pathRecorder("metrics")},
+	})
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "should match on host",
+			host:       "logs.local",
+			path:       "/aps/_search",
+			statusCode: http.StatusOK,
+			body:       "logs /aps/_search",
+		},
+		{
+			name:       "should match on host ignoring the port",
+			host:       "LOGS.local:9200",
+			path:       "/_search",
+			statusCode: http.StatusOK,
+			body:       "logs /_search",
+		},
+		{
+			name:       "should match on path prefix and strip it",
+			host:       "localhost:8080",
+			path:       "/aps/api/v1/query",
+			statusCode: http.StatusOK,
+			body:       "aps /api/v1/query",
+		},
+		{
+			name:       "should strip a prefix matching the whole path",
+			host:       "localhost:8080",
+			path:       "/aps",
+			statusCode: http.StatusOK,
+			body:       "aps /",
+		},
+		{
+			name:       "should match path prefixes on segment boundaries",
+			host:       "localhost:8080",
+			path:       "/apsx/_search",
+			statusCode: http.StatusNotFound,
+			body:       "no route matches request - localhost:8080 /apsx/_search",
+		},
+		{
+			name:       "should keep the prefix unless asked to strip it",
+			host:       "localhost:8080",
+			path:       "/metrics/x",
+			statusCode: http.StatusOK,
+			body:       "metrics /metrics/x",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Host = tt.host
+
+			router.ServeHTTP(r, req)
+
+			body, _ := io.ReadAll(r.Result().Body)
+			assert.Equal(t, tt.statusCode, r.Code)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+func TestRouter_SetRoutes(t *testing.T) {
+	router := NewRouter([]Route{{Name: "old", Handler: pathRecorder("old")}})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	old := router.Match(req)
+	router.SetRoutes([]Route{{Name: "new", Handler: pathRecorder("new")}})
+
+	assert.Equal(t, "old", old.Name)
+	assert.Equal(t, "new", router.Match(req).Name)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/minio/sha256-simd"
+)
+
+const (
+	// DefaultMemoryBufferSize is the amount of request body kept in memory before spilling to disk.
+	DefaultMemoryBufferSize = 8 << 20
+)
+
+// BodyTooLargeError is returned when a request body exceeds the configured maximum size.
+type BodyTooLargeError struct {
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds maximum size of %d bytes", e.Limit)
+}
+
+// spool buffers a request body so it can be hashed once and replayed for signing and sending.
+// Up to memLimit bytes are kept in memory, anything beyond is written to a temporary file.
+type spool struct {
+	memLimit int64
+	dir      string
+
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+	hash hash.Hash
+}
+
+func newSpool(memLimit int64, dir string) *spool {
+	if memLimit <= 0 {
+		memLimit = DefaultMemoryBufferSize
+	}
+
+	return &spool{
+		memLimit: memLimit,
+		dir:      dir,
+		hash:     sha256.New(),
+	}
+}
+
+// spoolBody reads r into a new spool, failing with a BodyTooLargeError once more than maxSize
+// bytes have been read. A maxSize of zero or less disables the limit.
+func spoolBody(r io.Reader, memLimit, maxSize int64, dir string) (*spool, error) {
+	s := newSpool(memLimit, dir)
+	if r == nil {
+		return s, nil
+	}
+
+	src := r
+	if maxSize > 0 {
+		src = io.LimitReader(r, maxSize+1)
+	}
+
+	if _, err := io.Copy(s, src); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if maxSize > 0 && s.size > maxSize {
+		s.Close()
+		return nil, &BodyTooLargeError{Limit: maxSize}
+	}
+
+	return s, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.hash.Write(p)
+
+	if s.file == nil && int64(s.mem.Len()+len(p)) > s.memLimit {
+		f, err := os.CreateTemp(s.dir, "aws-sigv4-proxy-body-")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file = f
+		s.mem = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+
+	return n, err
+}
+
+// Size returns the number of bytes in the spool.
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Sum returns the hex encoded SHA-256 of the spooled body.
+func (s *spool) Sum() string {
+	if s.size == 0 {
+		return emptyStringSHA256
+	}
+
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// OnDisk reports whether the body has been spilled to a temporary file.
+func (s *spool) OnDisk() bool {
+	return s.file != nil
+}
+
+// NewReader returns an independent reader positioned at the start of the body.
+func (s *spool) NewReader() io.ReadSeeker {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+
+	return bytes.NewReader(s.mem.Bytes())
+}
+
+// Section returns an independent reader over n bytes of the body starting at off.
+func (s *spool) Section(off, n int64) *io.SectionReader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, off, n)
+	}
+
+	return io.NewSectionReader(bytes.NewReader(s.mem.Bytes()), off, n)
+}
+
+// Close releases the temporary file backing the spool, if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	err := s.file.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	s.file = nil
+
+	return err
+}
+
+// cleanupReadCloser runs cleanup once the wrapped body has been closed.
+type cleanupReadCloser struct {
+	io.ReadCloser
+	cleanup func() error
+}
+
+func (c *cleanupReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if cErr := c.cleanup(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolBody(t *testing.T) {
+	tests := []struct {
+		name             string
+		size             int
+		memoryBufferSize int64
+		maxBodySize      int64
+		wantOnDisk       bool
+		wantErr          error
+	}{
+		{name: "should keep empty bodies in memory", size: 0, memoryBufferSize: 16},
+		{name: "should keep bodies of the memory buffer size in memory", size: 16, memoryBufferSize: 16},
+		{name: "should spill bodies over the memory buffer size to disk", size: 17, memoryBufferSize: 16, wantOnDisk: true},
+		{name: "should accept bodies of the maximum size", size: 32, memoryBufferSize: 16, maxBodySize: 32, wantOnDisk: true},
+		{name: "should reject bodies over the maximum size", size: 33, memoryBufferSize: 16, maxBodySize: 32, wantErr: &BodyTooLargeError{Limit: 32}},
+		{name: "should not limit bodies without a maximum size", size: 1024, memoryBufferSize: 16, wantOnDisk: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			payload := bytes.Repeat([]byte("a"), tt.size)
+
+			s, err := spoolBody(bytes.NewReader(payload), tt.memoryBufferSize, tt.maxBodySize, dir)
+			files, _ := os.ReadDir(dir)
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				assert.Len(t, files, 0)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tt.wantOnDisk, s.OnDisk())
+			if tt.wantOnDisk {
+				assert.Len(t, files, 1)
+			} else {
+				assert.Len(t, files, 0)
+			}
+			assert.Equal(t, int64(tt.size), s.Size())
+
+			sum := sha256.Sum256(payload)
+			assert.Equal(t, hex.EncodeToString(sum[:]), s.Sum())
+
+			// Readers are independent of each other
+			for i := 0; i < 2; i++ {
+				b, err := io.ReadAll(s.NewReader())
+				assert.NoError(t, err)
+				assert.Equal(t, payload, b)
+			}
+
+			assert.NoError(t, s.Close())
+			files, _ = os.ReadDir(dir)
+			assert.Len(t, files, 0)
+		})
+	}
+}
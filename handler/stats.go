@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// indexConcurrency bounds the _count requests made at once for the indices matching a pattern.
+	indexConcurrency = 8
+
+	// indexStatsTimeout bounds the requests counting the documents of the indices matching a pattern.
+	indexStatsTimeout = 30 * time.Second
+)
+
+// indexDocs is the number of documents of an index.
+type indexDocs struct {
+	name  string
+	count int64
+}
+
+// countIndexDocs resolves the comma separated index patterns of target, all indices when empty, from
+// their mappings and counts their documents, sorted by index name.
+func countIndexDocs(ctx context.Context, client Client, host, target string) ([]indexDocs, error) {
+	var mappings map[string]json.RawMessage
+	if err := getJSON(ctx, client, host, indexPath(target, "_mapping"), &mappings); err != nil {
+		return nil, err
+	}
+
+	indices := make([]indexDocs, 0, len(mappings))
+	for name := range mappings {
+		indices = append(indices, indexDocs{name: name})
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i].name < indices[j].name })
+
+	errs := make([]error, len(indices))
+	sem := make(chan struct{}, indexConcurrency)
+	var wg sync.WaitGroup
+	for i := range indices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var count struct {
+				Count int64 `json:"count"`
+			}
+			errs[i] = getJSON(ctx, client, host, indexPath(indices[i].name, "_count"), &count)
+			indices[i].count = count.Count
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return indices, nil
+}
+
+// indexPath prefixes api with the target indices, if any.
+func indexPath(target, api string) string {
+	if target == "" {
+		return "/" + api
+	}
+
+	return "/" + target + "/" + api
+}
+
+// IndexStats answers _stats for the indices matching the index pattern of the request, with their
+// document counts from upstream. AOSS does not report store sizes, they are zero. Counts are cached
+// for TTL so that dashboards polling _stats do not count every index every time.
+type IndexStats struct {
+	Client Client
+	// Host is the upstream host, the incoming Host header is used when empty.
+	Host string
+	TTL  time.Duration
+
+	cache ttlCache[indexStatsKey, []indexDocs]
+}
+
+// indexStatsKey tells cached counts apart by the role they were counted with, as upstream may let
+// clients of other roles see other indices.
+type indexStatsKey struct {
+	host   string
+	role   string
+	target string
+}
+
+type DocsStats struct {
+	Count   int64 `json:"count"`
+	Deleted int64 `json:"deleted"`
+}
+
+type StoreStats struct {
+	SizeInBytes     int64 `json:"size_in_bytes"`
+	ReservedInBytes int64 `json:"reserved_in_bytes"`
+}
+
+type CommonStats struct {
+	Docs  *DocsStats  `json:"docs,omitempty"`
+	Store *StoreStats `json:"store,omitempty"`
+}
+
+type IndexStatsEntry struct {
+	Uuid      string      `json:"uuid,omitempty"`
+	Primaries CommonStats `json:"primaries"`
+	Total     CommonStats `json:"total"`
+}
+
+type IndicesStats struct {
+	Shards  Shards                     `json:"_shards"`
+	All     IndexStatsEntry            `json:"_all"`
+	Indices map[string]IndexStatsEntry `json:"indices"`
+}
+
+func (h *IndexStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if log.GetLevel() == log.DebugLevel {
+		log.Debug("Intercepted _stats")
+	}
+
+	// {index}/_stats/{metrics}, where _all stands for every index and every metric
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	target, metrics := "", "_all"
+	if len(segments) > 0 && segments[0] != "_stats" && segments[0] != "_all" {
+		target = segments[0]
+	}
+	if len(segments) > 2 {
+		metrics = segments[2]
+	}
+
+	host := h.Host
+	if host == "" {
+		host = r.Host
+	}
+	indices, err := h.indexDocs(r.Context(), host, target)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+
+	stats := newIndicesStats(indices, strings.Split(metrics, ","))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		log.WithError(err).Warn("unable to encode _stats response")
+	}
+}
+
+// indexDocs returns the cached document counts of the indices matching target, counting them again
+// once expired. Concurrent requests for the same counts wait for a single computation, made with the
+// principal and role of ctx but not its deadline, as the counts are shared with other requests.
+func (h *IndexStats) indexDocs(ctx context.Context, host, target string) ([]indexDocs, error) {
+	role, err := clientRole(ctx, h.Client)
+	if err != nil {
+		return nil, err
+	}
+	key := indexStatsKey{host: host, role: role, target: target}
+
+	return h.cache.get(ctx, key, h.TTL, func() ([]indexDocs, error) {
+		ctx, cancel := context.WithTimeout(detachedContext(ctx), indexStatsTimeout)
+		defer cancel()
+		return countIndexDocs(ctx, h.Client, host, target)
+	})
+}
+
+// newIndicesStats reports the docs and store metrics asked for, other metrics are left out.
+func newIndicesStats(indices []indexDocs, metrics []string) IndicesStats {
+	docs, store := false, false
+	for _, metric := range metrics {
+		switch metric {
+		case "_all":
+			docs, store = true, true
+		case "docs":
+			docs = true
+		case "store":
+			store = true
+		}
+	}
+
+	stats := func(count int64) CommonStats {
+		var s CommonStats
+		if docs {
+			s.Docs = &DocsStats{Count: count}
+		}
+		if store {
+			s.Store = &StoreStats{}
+		}
+		return s
+	}
+
+	result := IndicesStats{
+		Shards:  Shards{Total: len(indices), Successful: len(indices), Failed: 0},
+		Indices: map[string]IndexStatsEntry{},
+	}
+	total := int64(0)
+	for _, index := range indices {
+		result.Indices[index.name] = IndexStatsEntry{Uuid: "_na_", Primaries: stats(index.count), Total: stats(index.count)}
+		total += index.count
+	}
+	result.All = IndexStatsEntry{Primaries: stats(total), Total: stats(total)}
+
+	return result
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexStats_ServeHTTP(t *testing.T) {
+	upstream := &jsonUpstream{responses: map[string]string{
+		"/_mapping":        `{"logs-b":{"mappings":{}},"logs-a":{"mappings":{}}}`,
+		"/logs-a/_mapping": `{"logs-a":{"mappings":{}}}`,
+		"/logs-a/_count":   `{"count":1200}`,
+		"/logs-b/_count":   `{"count":35}`,
+	}}
+	h := &IndexStats{Client: upstream, TTL: time.Minute}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   string
+	}{
+		{
+			name:   "should count the documents of every index",
+			target: "/_all/_stats/_all",
+			status: http.StatusOK,
+			want: `{"_shards":{"total":2,"successful":2,"failed":0},` +
+				`"_all":{"primaries":{"docs":{"count":1235,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}},"total":{"docs":{"count":1235,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}}},` +
+				`"indices":{` +
+				`"logs-a":{"uuid":"_na_","primaries":{"docs":{"count":1200,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}},"total":{"docs":{"count":1200,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}}},` +
+				`"logs-b":{"uuid":"_na_","primaries":{"docs":{"count":35,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}},"total":{"docs":{"count":35,"deleted":0},"store":{"size_in_bytes":0,"reserved_in_bytes":0}}}}}`,
+		},
+		{
+			name:   "should only report the requested indices and metrics",
+			target: "/logs-a/_stats/docs",
+			status: http.StatusOK,
+			want: `{"_shards":{"total":1,"successful":1,"failed":0},` +
+				`"_all":{"primaries":{"docs":{"count":1200,"deleted":0}},"total":{"docs":{"count":1200,"deleted":0}}},` +
+				`"indices":{"logs-a":{"uuid":"_na_","primaries":{"docs":{"count":1200,"deleted":0}},"total":{"docs":{"count":1200,"deleted":0}}}}}`,
+		},
+		{
+			name:   "should relay upstream errors",
+			target: "/missing/_stats/docs",
+			status: http.StatusNotFound,
+			want:   `{"error":{"type":"index_not_found_exception"},"status":404}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.JSONEq(t, tt.want, rec.Body.String())
+		})
+	}
+}
+
+func TestIndexStats_ServeHTTPCaches(t *testing.T) {
+	upstream := &jsonUpstream{responses: map[string]string{
+		"/logs/_mapping": `{"logs":{"mappings":{}}}`,
+		"/logs/_count":   `{"count":3}`,
+	}}
+	h := &IndexStats{Client: upstream, TTL: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/logs/_stats/docs", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	assert.Equal(t, []string{"GET /logs/_mapping", "GET /logs/_count"}, upstream.requested)
+}
+
+// signedUpstream answers every index with as many documents as the length of the access key the
+// request was signed with, and blocks the requests for the paths of block until it is closed or
+// their context is done.
+type signedUpstream struct {
+	mu    sync.Mutex
+	keys  []string
+	block map[string]chan struct{}
+}
+
+func (u *signedUpstream) Do(req *http.Request) (*http.Response, error) {
+	if ch, ok := u.block[req.URL.Path]; ok {
+		select {
+		case <-ch:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	credential := strings.Split(req.Header.Get("Authorization"), "Credential=")[1]
+	key := strings.Split(credential, "/")[0]
+	u.mu.Lock()
+	u.keys = append(u.keys, key)
+	u.mu.Unlock()
+
+	body := `{"count":` + strings.Repeat("1", len(key)) + `}`
+	if strings.HasSuffix(req.URL.Path, "/_mapping") {
+		body = `{"logs":{"mappings":{}}}`
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestIndexStats_ServeHTTPCachesPerRole(t *testing.T) {
+	upstream := &signedUpstream{}
+	h := &IndexStats{
+		Client: &ProxyClient{
+			Signer:              v4.NewSigner(credentials.NewStaticCredentials("AK", "secret", "")),
+			Client:              upstream,
+			Roles:               []RoleSigner{{Name: "ingest", Principals: []string{"fluent-bit"}, Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "secret", ""))}},
+			SigningNameOverride: "aoss",
+			RegionOverride:      "us-west-2",
+		},
+		Host: "stats.host",
+		TTL:  time.Minute,
+	}
+
+	for _, principal := range []string{"alice", "fluent-bit", "alice", "fluent-bit"} {
+		req := httptest.NewRequest("GET", "/logs/_stats/docs", nil)
+		req = req.WithContext(WithPrincipal(req.Context(), &Principal{Name: principal}))
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		want := `"count":11`
+		if principal == "fluent-bit" {
+			want = `"count":1111`
+		}
+		assert.Contains(t, rec.Body.String(), want)
+	}
+
+	assert.Equal(t, []string{"AK", "AK", "AKID", "AKID"}, upstream.keys)
+}
+
+func TestIndexStats_indexDocsConcurrent(t *testing.T) {
+	unblock := make(chan struct{})
+	upstream := &signedUpstream{block: map[string]chan struct{}{"/slow/_mapping": unblock}}
+	h := &IndexStats{
+		Client: &ProxyClient{
+			Signer:              v4.NewSigner(credentials.NewStaticCredentials("AK", "secret", "")),
+			Client:              upstream,
+			SigningNameOverride: "aoss",
+			RegionOverride:      "us-west-2",
+		},
+		TTL: time.Minute,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := h.indexDocs(context.Background(), "stats.host", "slow")
+			assert.NoError(t, err)
+		}()
+	}
+
+	// Counts of other indices are not held up by the slow ones
+	indices, err := h.indexDocs(context.Background(), "stats.host", "logs")
+	assert.NoError(t, err)
+	assert.Equal(t, []indexDocs{{name: "logs", count: 11}}, indices)
+
+	close(unblock)
+	wg.Wait()
+	// Both requests for the slow index waited for a single count
+	assert.Len(t, upstream.keys, 4)
+}
+
+func TestIndexStats_indexDocsFirstCallerCanceled(t *testing.T) {
+	unblock := make(chan struct{})
+	upstream := &signedUpstream{block: map[string]chan struct{}{"/logs/_mapping": unblock}}
+	h := &IndexStats{
+		Client: &ProxyClient{
+			Signer:              v4.NewSigner(credentials.NewStaticCredentials("AK", "secret", "")),
+			Client:              upstream,
+			Roles:               []RoleSigner{{Name: "ingest", Principals: []string{"fluent-bit"}, Signer: v4.NewSigner(credentials.NewStaticCredentials("AKID", "secret", ""))}},
+			SigningNameOverride: "aoss",
+			RegionOverride:      "us-west-2",
+		},
+		TTL: time.Minute,
+	}
+	ctx := WithPrincipal(context.Background(), &Principal{Name: "fluent-bit"})
+
+	first, cancel := context.WithCancel(ctx)
+	firstErr := make(chan error)
+	go func() {
+		_, err := h.indexDocs(first, "stats.host", "logs")
+		firstErr <- err
+	}()
+	assert.Eventually(t, func() bool {
+		h.cache.mu.Lock()
+		defer h.cache.mu.Unlock()
+		return len(h.cache.entries) == 1
+	}, time.Second, time.Millisecond)
+
+	type result struct {
+		indices []indexDocs
+		err     error
+	}
+	second := make(chan result)
+	go func() {
+		indices, err := h.indexDocs(ctx, "stats.host", "logs")
+		second <- result{indices, err}
+	}()
+
+	// The first client going away does not fail the count the second one waits for
+	cancel()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+	close(unblock)
+
+	got := <-second
+	assert.NoError(t, got.err)
+	// Counted with the role of the principal
+	assert.Equal(t, []indexDocs{{name: "logs", count: 1111}}, got.indices)
+	assert.Equal(t, []string{"AKID", "AKID"}, upstream.keys)
+}
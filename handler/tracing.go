@@ -0,0 +1,53 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "aws-sigv4-proxy/handler"
+)
+
+// traceContext reads and writes W3C traceparent and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// tracer returns the tracer of the requests made with ctx, which does not record probes of upstream.
+func (p *ProxyClient) tracer(ctx context.Context) trace.Tracer {
+	if isProbe(ctx) {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	if p.Tracer != nil {
+		return p.Tracer
+	}
+
+	return otel.Tracer(tracerName)
+}
+
+// endSpan ends span, marking it failed when err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestProxyClient_DoTracing(t *testing.T) {
+	const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name      string
+		provider  *mockProvider
+		wantSpans []string
+		wantCode  codes.Code
+	}{
+		{
+			name:      "should trace each step of a proxied request",
+			provider:  &mockProvider{},
+			wantSpans: []string{"hash body", "retrieve credentials", "sign", "upstream round trip", "proxy GET"},
+			wantCode:  codes.Unset,
+		},
+		{
+			name:      "should mark the request failed when credentials cannot be retrieved",
+			provider:  &mockProvider{Fail: true},
+			wantSpans: []string{"hash body", "retrieve credentials", "proxy GET"},
+			wantCode:  codes.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			client := &bodyReadingHTTPClient{}
+			proxyClient := &ProxyClient{
+				Signer:              v4.NewSigner(credentials.NewCredentials(tt.provider)),
+				Client:              client,
+				SigningNameOverride: "aoss",
+				RegionOverride:      "us-west-2",
+				Tracer:              tp.Tracer("test"),
+			}
+
+			proxyClient.Do(&http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/logs/_search"},
+				Host:   "tracing.host",
+				Header: http.Header{"Traceparent": []string{incomingTraceparent}},
+			})
+
+			spans := exporter.GetSpans()
+			names := make([]string, len(spans))
+			for i, span := range spans {
+				names[i] = span.Name
+			}
+			assert.Equal(t, tt.wantSpans, names)
+
+			root := spans[len(spans)-1]
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext.TraceID().String())
+			assert.Equal(t, "00f067aa0ba902b7", root.Parent.SpanID().String())
+			assert.Equal(t, trace.SpanKindClient, root.SpanKind)
+			assert.Equal(t, tt.wantCode, root.Status.Code)
+			for _, span := range spans[:len(spans)-1] {
+				assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID())
+			}
+
+			if client.Request == nil {
+				return
+			}
+
+			// The upstream request continues the trace from the round trip span
+			roundTrip := spans[len(spans)-2]
+			upstream := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(
+				client.Request.Context(), propagation.HeaderCarrier(client.Request.Header)))
+			assert.Equal(t, roundTrip.SpanContext.TraceID(), upstream.TraceID())
+			assert.Equal(t, roundTrip.SpanContext.SpanID(), upstream.SpanID())
+		})
+	}
+}
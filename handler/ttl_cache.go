@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ttlCache caches the values of keys for a time to live. Concurrent callers asking for the same key
+// wait for a single computation, which runs apart from them so that a caller going away does not
+// fail the others. Failures are not cached, the next caller computes again. The zero value is ready
+// to use.
+type ttlCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]*ttlEntry[V]
+}
+
+// ttlEntry is the value of a key, available once ready is closed.
+type ttlEntry[V any] struct {
+	ready   chan struct{}
+	value   V
+	err     error
+	expires time.Time
+}
+
+// expired tells whether the value is ready and expired, values still being computed are not.
+func (e *ttlEntry[V]) expired(now time.Time) bool {
+	select {
+	case <-e.ready:
+		return !now.Before(e.expires)
+	default:
+		return false
+	}
+}
+
+// get returns the value of key, computing it with compute when missing or expired, to be kept for
+// ttl. The wait ends early when ctx is done, the computation does not.
+func (c *ttlCache[K, V]) get(ctx context.Context, key K, ttl time.Duration, compute func() (V, error)) (V, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = map[K]*ttlEntry[V]{}
+	}
+	// Drop expired entries so that keys seen once do not pile up
+	for k, entry := range c.entries {
+		if entry.expired(now) {
+			delete(c.entries, k)
+		}
+	}
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &ttlEntry[V]{ready: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		go func() {
+			entry.value, entry.err = compute()
+			entry.expires = time.Now().Add(ttl)
+			if entry.err != nil {
+				c.mu.Lock()
+				if c.entries[key] == entry {
+					delete(c.entries, key)
+				}
+				c.mu.Unlock()
+			}
+			close(entry.ready)
+		}()
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.value, entry.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
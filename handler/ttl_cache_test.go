@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCache_get(t *testing.T) {
+	var c ttlCache[string, int]
+	computed := 0
+	compute := func(err error) func() (int, error) {
+		return func() (int, error) {
+			computed++
+			return computed, err
+		}
+	}
+
+	// Failures are not cached
+	_, err := c.get(context.Background(), "a", time.Hour, compute(errors.New("failed")))
+	assert.EqualError(t, err, "failed")
+	v, err := c.get(context.Background(), "a", time.Hour, compute(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+
+	// Values are kept until they expire
+	v, _ = c.get(context.Background(), "a", time.Hour, compute(nil))
+	assert.Equal(t, 2, v)
+	v, _ = c.get(context.Background(), "b", 0, compute(nil))
+	assert.Equal(t, 3, v)
+	v, _ = c.get(context.Background(), "b", 0, compute(nil))
+	assert.Equal(t, 4, v)
+
+	// Waits end with their context, not the computation
+	unblock := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.get(ctx, "c", time.Hour, func() (int, error) {
+		<-unblock
+		return 5, nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	close(unblock)
+	v, err = c.get(context.Background(), "c", time.Hour, compute(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, v)
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License").
+ * You may not use this file except in compliance with the License.
+ * A copy of the License is located at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * or in the "license" file accompanying this file. This file is distributed
+ * on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * express or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// upstreamError is a response other than 200 OK to a request the proxy made on its own.
+type upstreamError struct {
+	method string
+	path   string
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream answered %d to %s %s", e.status, e.method, e.path)
+}
+
+// getJSON makes a signed GET request for path to host through client and decodes the JSON answer into v.
+func getJSON(ctx context.Context, client Client, host, path string, v interface{}) error {
+	return requestJSON(ctx, client, http.MethodGet, host, path, nil, v)
+}
+
+// postJSON makes a signed POST request with the JSON encoding of body, and decodes the JSON answer into v.
+func postJSON(ctx context.Context, client Client, host, path string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return requestJSON(ctx, client, http.MethodPost, host, path, b, v)
+}
+
+func requestJSON(ctx context.Context, client Client, method, host, path string, body []byte, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, r)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{method: method, path: path, status: resp.StatusCode, header: resp.Header, body: b}
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// writeUpstreamError relays the answer of upstream to a request the proxy made on behalf of a client,
+// such as an index_not_found_exception, or answers like writeProxyError when there was none.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var upstream *upstreamError
+	if !errors.As(err, &upstream) {
+		writeProxyError(w, err)
+		return
+	}
+
+	writeResponse(w, &http.Response{StatusCode: upstream.status, Header: upstream.header}, upstream.body)
+}